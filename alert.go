@@ -0,0 +1,33 @@
+package main
+
+// AlertRule is a condition that raises an alert when it holds. What Threshold means
+// depends on the Kind:
+//
+//   - pool_utilisation / aws_utilisation: percentage of the storage size used
+//   - reconciliation_drift: gigabytes between the network counters and the sum of the users' usage
+//   - user_over_quota: percentage of the user's account quota used
+type AlertRule struct {
+	Name      string  `bson:"name" json:"name"`
+	Kind      string  `bson:"kind" json:"kind"`
+	Threshold float64 `bson:"threshold" json:"threshold"`
+	Enabled   bool    `bson:"enabled" json:"enabled"`
+}
+
+// Alert is raised when an alert rule's condition holds for a subject (the network or
+// a user). It is resolved once the condition stops holding.
+type Alert struct {
+	Key        string  `bson:"key" json:"key"`
+	RuleName   string  `bson:"rule_name" json:"rule_name"`
+	Kind       string  `bson:"kind" json:"kind"`
+	Subject    string  `bson:"subject" json:"subject"`
+	Message    string  `bson:"message" json:"message"`
+	Value      float64 `bson:"value" json:"value"`
+	Threshold  float64 `bson:"threshold" json:"threshold"`
+	FiredAt    int64   `bson:"fired_at" json:"fired_at"`       // in unix time
+	ResolvedAt int64   `bson:"resolved_at" json:"resolved_at"` // in unix time, 0 while the alert is active
+}
+
+// Resolved reports whether the alert's condition no longer holds.
+func (a Alert) Resolved() bool {
+	return a.ResolvedAt != 0
+}
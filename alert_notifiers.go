@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// AlertNotifier delivers fired and resolved alerts to operators.
+type AlertNotifier interface {
+	Name() string
+	Notify(alert Alert) error
+}
+
+// LogNotifier writes alerts to the server log.
+type LogNotifier struct{}
+
+func (LogNotifier) Name() string {
+	return "log"
+}
+
+func (LogNotifier) Notify(alert Alert) error {
+	log.Println(alertSummary(alert))
+	return nil
+}
+
+// WebhookNotifier POSTs alerts as JSON to a URL.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n WebhookNotifier) Notify(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SMTPNotifier emails alerts through an SMTP relay that does not require authentication,
+// such as a relay running on the same machine.
+type SMTPNotifier struct {
+	Addr string
+	From string
+	To   []string
+}
+
+func (n SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (n SMTPNotifier) Notify(alert Alert) error {
+	message := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\n\r\n%v\r\n",
+		n.From, strings.Join(n.To, ", "), alertSummary(alert), alert.Message)
+
+	return smtp.SendMail(n.Addr, nil, n.From, n.To, []byte(message))
+}
+
+// alertSummary returns a one line description of the alert.
+func alertSummary(alert Alert) string {
+	if alert.Resolved() {
+		return fmt.Sprintf("[RESOLVED] %v (%v)", alert.RuleName, alert.Subject)
+	}
+
+	return fmt.Sprintf("[ALERT] %v (%v): %v", alert.RuleName, alert.Subject, alert.Message)
+}
+
+// AlertNotifiersFromEnv returns the notifiers configured through the environment. The log
+// notifier is always included.
+//
+//   - SHR_ALERT_WEBHOOK_URL enables the webhook notifier
+//   - SHR_ALERT_SMTP_ADDR, SHR_ALERT_SMTP_FROM and SHR_ALERT_SMTP_TO (comma separated)
+//     enable the SMTP notifier
+func AlertNotifiersFromEnv() []AlertNotifier {
+	notifiers := []AlertNotifier{LogNotifier{}}
+
+	if url := os.Getenv("SHR_ALERT_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, WebhookNotifier{
+			URL:    url,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	if addr := os.Getenv("SHR_ALERT_SMTP_ADDR"); addr != "" {
+		to := strings.Split(os.Getenv("SHR_ALERT_SMTP_TO"), ",")
+		from := os.Getenv("SHR_ALERT_SMTP_FROM")
+
+		if from == "" || os.Getenv("SHR_ALERT_SMTP_TO") == "" {
+			log.Println("SHR_ALERT_SMTP_FROM and SHR_ALERT_SMTP_TO must be set, SMTP alerts disabled")
+		} else {
+			notifiers = append(notifiers, SMTPNotifier{Addr: addr, From: from, To: to})
+		}
+	}
+
+	return notifiers
+}
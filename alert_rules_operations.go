@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultAlertRules are used until an alert rule has been saved.
+var DefaultAlertRules = []AlertRule{
+	{Name: "storage-pool-nearly-full", Kind: ALERT_POOL_UTILISATION, Threshold: 90, Enabled: true},
+	{Name: "aws-storage-nearly-full", Kind: ALERT_AWS_UTILISATION, Threshold: 90, Enabled: true},
+	{Name: "network-counters-drift", Kind: ALERT_RECONCILIATION_DRIFT, Threshold: 1, Enabled: true},
+	{Name: "user-over-quota", Kind: ALERT_USER_OVER_QUOTA, Threshold: 100, Enabled: true},
+}
+
+// GetAlertRules returns the saved alert rules, or the default rules if none have been saved.
+func GetAlertRules() ([]AlertRule, error) {
+	cursor, err := alertRulesColl.Find(context.Background(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []AlertRule
+	if err := cursor.All(context.Background(), &rules); err != nil {
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		return DefaultAlertRules, nil
+	}
+
+	return rules, nil
+}
+
+// SaveAlertRule inserts the alert rule, or replaces the rule with the same name.
+func SaveAlertRule(rule AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("alert rule name not provided")
+	}
+
+	switch rule.Kind {
+	case ALERT_POOL_UTILISATION, ALERT_AWS_UTILISATION, ALERT_RECONCILIATION_DRIFT, ALERT_USER_OVER_QUOTA:
+	default:
+		return fmt.Errorf("invalid alert rule kind [%v]", rule.Kind)
+	}
+
+	// Saving the first rule replaces the defaults, so keep them unless they are being overridden
+	if count, err := alertRulesColl.CountDocuments(context.Background(), bson.D{}); err != nil {
+		return err
+	} else if count == 0 {
+		for _, defaultRule := range DefaultAlertRules {
+			if defaultRule.Name != rule.Name {
+				if _, err := alertRulesColl.InsertOne(context.Background(), defaultRule); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	filter := bson.D{{Key: "name", Value: rule.Name}}
+	if _, err := alertRulesColl.ReplaceOne(context.Background(), filter, rule, options.Replace().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteAlertRule deletes the alert rule with the given name.
+func DeleteAlertRule(name string) (bool, error) {
+	filter := bson.D{{Key: "name", Value: name}}
+
+	result, err := alertRulesColl.DeleteOne(context.Background(), filter)
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
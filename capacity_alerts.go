@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// alertManager keeps track of the active alerts so that an alert is only delivered
+// once when it fires and once more when it is resolved. The active alerts are stored in
+// Mongo as well, so that they do not fire again after a restart.
+type alertManager struct {
+	mu        sync.Mutex
+	active    map[string]Alert
+	notifiers []AlertNotifier
+	trigger   chan struct{}
+}
+
+var alerts = &alertManager{
+	active:  make(map[string]Alert),
+	trigger: make(chan struct{}, 1),
+}
+
+// SetNotifiers sets the notifiers alerts are delivered through.
+func (m *alertManager) SetNotifiers(notifiers []AlertNotifier) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.notifiers = notifiers
+}
+
+// Load reads the alerts that were active when the server last stopped.
+func (m *alertManager) Load() error {
+	cursor, err := activeAlertsColl.Find(context.Background(), bson.D{})
+	if err != nil {
+		return err
+	}
+
+	var active []Alert
+	if err := cursor.All(context.Background(), &active); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, alert := range active {
+		m.active[alert.Key] = alert
+	}
+
+	return nil
+}
+
+// Active returns the alerts that are currently firing, oldest first.
+func (m *alertManager) Active() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := []Alert{}
+	for _, alert := range m.active {
+		active = append(active, alert)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].FiredAt < active[j].FiredAt })
+
+	return active
+}
+
+// update records whether the rule's condition holds for the subject. A notification
+// is sent when the alert starts firing and when it is resolved, but not in between.
+func (m *alertManager) update(rule AlertRule, subject string, holds bool, value float64, message string) {
+	key := rule.Name + ":" + subject
+
+	m.mu.Lock()
+	alert, active := m.active[key]
+
+	if holds && !active {
+		alert = Alert{
+			Key:       key,
+			RuleName:  rule.Name,
+			Kind:      rule.Kind,
+			Subject:   subject,
+			Message:   message,
+			Value:     value,
+			Threshold: rule.Threshold,
+			FiredAt:   time.Now().Unix(),
+		}
+		m.active[key] = alert
+	} else if holds && active {
+		// Still firing, only refresh the current value
+		alert.Value = value
+		alert.Message = message
+		m.active[key] = alert
+		m.mu.Unlock()
+		return
+	} else if !holds && active {
+		alert.ResolvedAt = time.Now().Unix()
+		delete(m.active, key)
+	} else {
+		m.mu.Unlock()
+		return
+	}
+
+	notifiers := m.notifiers
+	m.mu.Unlock()
+
+	var err error
+	if alert.Resolved() {
+		_, err = activeAlertsColl.DeleteOne(context.Background(), bson.D{{Key: "key", Value: key}})
+	} else {
+		_, err = activeAlertsColl.ReplaceOne(context.Background(), bson.D{{Key: "key", Value: key}}, alert, options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		log.Printf("Unable to store alert %v: %v\n", key, err)
+	}
+
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(alert); err != nil {
+			log.Printf("Unable to deliver alert %v through %v: %v\n", key, notifier.Name(), err)
+		}
+	}
+}
+
+// resolveMissingRules resolves the active alerts whose rule was deleted or disabled.
+func (m *alertManager) resolveMissingRules(rules []AlertRule) {
+	enabled := make(map[string]bool)
+	for _, rule := range rules {
+		enabled[rule.Name] = rule.Enabled
+	}
+
+	for _, alert := range m.Active() {
+		if !enabled[alert.RuleName] {
+			m.update(AlertRule{Name: alert.RuleName, Kind: alert.Kind, Threshold: alert.Threshold}, alert.Subject, false, 0, "")
+		}
+	}
+}
+
+// TriggerNetworkAlertEvaluation asks the alert evaluator to check the network alert
+// rules. Triggers that arrive while an evaluation is pending are coalesced.
+func TriggerNetworkAlertEvaluation() {
+	select {
+	case alerts.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// RunAlertEvaluator evaluates the network alert rules every time they are triggered.
+// It blocks and is meant to be run in its own goroutine.
+func RunAlertEvaluator() {
+	for range alerts.trigger {
+		if err := EvaluateNetworkAlerts(); err != nil {
+			log.Println("Unable to evaluate network alerts:", err)
+		}
+	}
+}
+
+// EvaluateNetworkAlerts checks the utilisation and reconciliation drift rules against the
+// current network storage state.
+func EvaluateNetworkAlerts() error {
+	rules, err := GetAlertRules()
+	if err != nil {
+		return err
+	}
+	alerts.resolveMissingRules(rules)
+
+	var state NetworkStorageState
+	if err := findNetworkStateInMongo(&state); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+
+		switch rule.Kind {
+		case ALERT_POOL_UTILISATION:
+			used := percentage(state.TotalStoragePoolUsed, state.TotalStoragePoolSize)
+			alerts.update(rule, "network", used > rule.Threshold, used,
+				fmt.Sprintf("Storage pool is %.1f%% full (%.2f of %.2f GB used)", used, state.TotalStoragePoolUsed, state.TotalStoragePoolSize))
+
+		case ALERT_AWS_UTILISATION:
+			used := percentage(state.TotalAwsStorageUsed, state.TotalAwsStorageSize)
+			alerts.update(rule, "network", used > rule.Threshold, used,
+				fmt.Sprintf("AWS storage is %.1f%% full (%.2f of %.2f GB used)", used, state.TotalAwsStorageUsed, state.TotalAwsStorageSize))
+
+		case ALERT_RECONCILIATION_DRIFT:
+			userSpoolUsed, userAwsUsed, err := sumUserCapacityUsed()
+			if err != nil {
+				return err
+			}
+
+			// Deduplicated files are charged to every user but only stored once
+			referencedSpool, referencedAws, err := sumReferencedCapacity()
+			if err != nil {
+				return err
+			}
+			userSpoolUsed -= referencedSpool
+			userAwsUsed -= referencedAws
+
+			spoolDrift := state.TotalStoragePoolUsed - userSpoolUsed
+			awsDrift := state.TotalAwsStorageUsed - userAwsUsed
+			drift := math.Max(math.Abs(spoolDrift), math.Abs(awsDrift))
+
+			alerts.update(rule, "network", drift > rule.Threshold, drift,
+				fmt.Sprintf("Network counters differ from the users' usage by %.2f GB (storage pool) and %.2f GB (AWS)", spoolDrift, awsDrift))
+		}
+	}
+
+	return nil
+}
+
+// EvaluateUserAlerts checks the user quota rules against the given user.
+func EvaluateUserAlerts(username string) error {
+	rules, err := GetAlertRules()
+	if err != nil {
+		return err
+	}
+
+	user, err := GetUserByUsername(username)
+	deleted := err != nil
+
+	for _, rule := range rules {
+		if rule.Kind != ALERT_USER_OVER_QUOTA {
+			continue
+		}
+
+		if deleted || !rule.Enabled {
+			alerts.update(rule, username, false, 0, "")
+			continue
+		}
+
+		quota := accountQuota(user.AccountType)
+		used := percentage(user.SpoolCapacityUsed+user.AwsCapacityUsed, quota)
+
+		alerts.update(rule, username, used > rule.Threshold, used,
+			fmt.Sprintf("User %v has used %.1f%% of their %.0f GB quota", username, used, quota))
+	}
+
+	return nil
+}
+
+// accountQuota returns the storage (in gigabytes) included with the account type.
+func accountQuota(accountType string) float64 {
+	switch accountType {
+	case MONTHLY_SUB:
+		return MONTHLY_STORAGE_SIZE
+	case FIXED_AMOUNT_1:
+		return FIXED_AMOUNT_1_STORAGE_SIZE
+	case FIXED_AMOUNT_2:
+		return FIXED_AMOUNT_2_STORAGE_SIZE
+	default:
+		return 0
+	}
+}
+
+// sumUserCapacityUsed returns the storage pool and AWS capacity used by all users combined.
+func sumUserCapacityUsed() (float64, float64, error) {
+	pipeline := bson.A{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "spool", Value: bson.D{{Key: "$sum", Value: "$spool_capacity_used"}}},
+			{Key: "aws", Value: bson.D{{Key: "$sum", Value: "$aws_capacity_used"}}},
+		}}},
+	}
+
+	cursor, err := userDetailsColl.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var results []struct {
+		Spool float64 `bson:"spool"`
+		Aws   float64 `bson:"aws"`
+	}
+	if err := cursor.All(context.Background(), &results); err != nil {
+		return 0, 0, err
+	}
+
+	if len(results) == 0 {
+		return 0, 0, nil
+	}
+
+	return results[0].Spool, results[0].Aws, nil
+}
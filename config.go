@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// envDuration returns the duration stored in the given environment variable (e.g. "5m"),
+// or fallback if the variable is unset or invalid.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid duration [%v] for %v, using %v\n", value, name, fallback)
+		return fallback
+	}
+
+	return duration
+}
+
+// requireAdmin checks that the request carries the admin token from SHR_ADMIN_TOKEN in its
+// X-Admin-Token header, and sends an error response if it does not. If SHR_ADMIN_TOKEN is
+// not set, admin routes are closed.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := os.Getenv("SHR_ADMIN_TOKEN")
+	if token == "" {
+		w.WriteHeader(http.StatusForbidden)
+		SendResponse(w, false, "Admin routes are disabled, SHR_ADMIN_TOKEN is not set", nil)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		SendResponse(w, false, "Admin token required", nil)
+		return false
+	}
+
+	return true
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 const (
 	PORT = 12345
 )
@@ -8,9 +10,26 @@ const (
 const (
 	DB_NAME = "shr-network-information"
 
-	STORAGE_CAPACITY_COLL_NAME = "storage-capacity-info"
-	UPLOADED_FILES_COLL_NAME   = "uploaded-files"
-	USER_DETAILS_COLL_NAME     = "user-details"
+	STORAGE_CAPACITY_COLL_NAME     = "storage-capacity-info"
+	UPLOADED_FILES_COLL_NAME       = "uploaded-files"
+	USER_DETAILS_COLL_NAME         = "user-details"
+	NETWORK_HISTORY_COLL_NAME      = "network-history"
+	ALERT_RULES_COLL_NAME          = "alert-rules"
+	ACTIVE_ALERTS_COLL_NAME        = "active-alerts"
+	WEBHOOKS_COLL_NAME             = "webhook-subscriptions"
+	WEBHOOK_DEAD_LETTERS_COLL_NAME = "webhook-dead-letters"
+	HOSTS_COLL_NAME                = "hosts"
+	REPAIR_JOBS_COLL_NAME          = "repair-jobs"
+	STORAGE_CHALLENGES_COLL_NAME   = "storage-challenges"
+	CREDIT_LEDGER_COLL_NAME        = "credit-ledger"
+	INTRODUCTIONS_COLL_NAME        = "introductions"
+	CORRUPTION_REPORTS_COLL_NAME   = "corruption-reports"
+	FOLDERS_COLL_NAME              = "folders"
+	SHARE_GRANTS_COLL_NAME         = "share-grants"
+	KEY_ENVELOPES_COLL_NAME        = "key-envelopes"
+	SHARD_PURGES_COLL_NAME         = "shard-purges"
+	MIGRATION_JOBS_COLL_NAME       = "migration-jobs"
+	DEDUP_CHALLENGES_COLL_NAME     = "dedup-challenges"
 )
 
 // Storage capacity constants
@@ -28,3 +47,212 @@ const (
 	FIXED_AMOUNT_1 = "fa1"
 	FIXED_AMOUNT_2 = "fa2"
 )
+
+// Network state event constants
+const (
+	NETWORK_STATE_EVENT_BUFFER_SIZE  = 100 // events kept for Last-Event-ID resume
+	NETWORK_STATE_KEEPALIVE_INTERVAL = 15  // in seconds
+)
+
+// Network history constants
+const (
+	NETWORK_HISTORY_SNAPSHOT_INTERVAL = 5 * time.Minute   // override with SHR_HISTORY_SNAPSHOT_INTERVAL
+	NETWORK_HISTORY_DEFAULT_RANGE     = 30 * 24 * 60 * 60 // in seconds
+	NETWORK_HISTORY_DEFAULT_POINTS    = 200
+	NETWORK_HISTORY_MAX_POINTS        = 5000
+
+	NETWORK_FORECAST_DEFAULT_WINDOW  = 90 // in days
+	NETWORK_FORECAST_DEFAULT_HORIZON = 30 // in days
+)
+
+// Alert rule kinds
+const (
+	ALERT_POOL_UTILISATION     = "pool_utilisation"
+	ALERT_AWS_UTILISATION      = "aws_utilisation"
+	ALERT_RECONCILIATION_DRIFT = "reconciliation_drift"
+	ALERT_USER_OVER_QUOTA      = "user_over_quota"
+)
+
+// Webhook event types
+const (
+	EVENT_USER_REGISTERED   = "user.registered"
+	EVENT_USER_UPDATED      = "user.updated"
+	EVENT_USER_PLAN_CHANGED = "user.plan_changed"
+	EVENT_USER_DELETED      = "user.deleted"
+	EVENT_FILE_UPLOADED     = "file.uploaded"
+	EVENT_FILE_DELETED      = "file.deleted"
+)
+
+// Webhook delivery constants
+const (
+	WEBHOOK_TIMEOUT         = 10 * time.Second
+	WEBHOOK_MAX_ATTEMPTS    = 6
+	WEBHOOK_INITIAL_BACKOFF = 2 * time.Second // doubled after every failed attempt
+)
+
+// Host liveness constants. A host is online until HOST_STALE_AFTER has passed since its
+// last heartbeat, stale until HOST_DEAD_AFTER has passed, and dead after that.
+const (
+	HOST_ONLINE = "online"
+	HOST_STALE  = "stale"
+	HOST_DEAD   = "dead"
+
+	HOST_HEARTBEAT_INTERVAL = 1 * time.Minute // how often nodes are expected to send heartbeats
+	HOST_STALE_AFTER        = 3 * time.Minute
+	HOST_DEAD_AFTER         = 30 * time.Minute
+
+	// Heartbeats closer together than this are not counted towards uptime, so that sending
+	// them faster does not make up for time offline. It is a little under the interval so
+	// that nodes sending them on time are not held back by jitter.
+	HOST_HEARTBEAT_COUNT_GAP = HOST_HEARTBEAT_INTERVAL - 10*time.Second
+
+	HOST_DEFAULT_AVAILABILITY = 0.5 // assumed for hosts without a day of heartbeat history
+
+	HOST_ADDRESS_INDEX_NAME = "host_address_unique"
+)
+
+// Shard repair constants
+const (
+	REPAIR_PENDING   = "pending"
+	REPAIR_CONFIRMED = "confirmed"
+	REPAIR_FAILED    = "failed"
+	REPAIR_CANCELLED = "cancelled" // the file left the storage pool
+
+	REPAIR_PLAN_INTERVAL  = 10 * time.Minute // override with SHR_REPAIR_PLAN_INTERVAL
+	REPAIR_DEAD_THRESHOLD = 2 * time.Hour    // how long a host must be dead before its shards are repaired
+	REPAIR_JOB_TIMEOUT    = 6 * time.Hour
+)
+
+// File placement constants
+const (
+	STORE_DEFAULT_REPLICAS = 1 // hosts per shard when the node does not ask for more
+
+	// PLACEMENT_RESERVE_ATTEMPTS is how many placements are tried when concurrent uploads
+	// take the space on the picked hosts first
+	PLACEMENT_RESERVE_ATTEMPTS = 3
+
+	// PLACEMENT_TIMEZONE_WEIGHT is how strongly placement prefers hosts in timezones the
+	// file does not use yet, relative to the hours of the day they cover (0-1)
+	PLACEMENT_TIMEZONE_WEIGHT = 0.25
+)
+
+// Deduplication constants
+const (
+	DEDUP_CHALLENGE_LEAVES  = 4 // chunks an uploader must return to prove they hold content
+	DEDUP_CHALLENGE_TIMEOUT = 1 * time.Hour
+)
+
+// Proof-of-storage challenge constants
+const (
+	CHALLENGE_PENDING = "pending"
+	CHALLENGE_PASSED  = "passed"
+	CHALLENGE_FAILED  = "failed"
+
+	// The shard the challenge was about no longer exists as it was, so it proves nothing
+	CHALLENGE_CANCELLED = "cancelled"
+
+	CHALLENGE_INTERVAL         = 15 * time.Minute // override with SHR_CHALLENGE_INTERVAL
+	CHALLENGE_FILES_PER_ROUND  = 20
+	CHALLENGE_RESPONSE_TIMEOUT = 1 * time.Hour
+)
+
+// Host reputation constants. The weights add up to 1.
+const (
+	REPUTATION_DEFAULT          = 0.5 // given to new hosts until their first update
+	REPUTATION_UPDATE_INTERVAL  = 1 * time.Hour
+	REPUTATION_MATURITY         = 90 * 24 * time.Hour // account age that earns the full age score
+	REPUTATION_UPTIME_WEIGHT    = 0.35
+	REPUTATION_CHALLENGE_WEIGHT = 0.35
+	REPUTATION_REPAIR_WEIGHT    = 0.15
+	REPUTATION_AGE_WEIGHT       = 0.15
+
+	// REPUTATION_SELECTION_FLOOR is the placement weight of a host with a reputation of 0,
+	// relative to a host with a reputation of 1
+	REPUTATION_SELECTION_FLOOR = 0.2
+)
+
+// Storage credit constants
+const (
+	CREDIT_HOSTING    = "hosting"    // earned for hosting other users' shards
+	CREDIT_USAGE      = "usage"      // spent on the user's own storage pool usage
+	CREDIT_SETTLEMENT = "settlement" // marks the end of a settled period
+
+	CREDITS_PER_HOSTED_GB_HOUR = 1.0
+	CREDITS_PER_USED_GB_HOUR   = 1.0
+
+	CREDITS_SETTLEMENT_INTERVAL   = 1 * time.Hour
+	CREDITS_MAX_SETTLEMENT_PERIOD = 24 * time.Hour // longer gaps (e.g. downtime) are not back-filled
+	CREDITS_LEDGER_ENTRIES_SHOWN  = 50
+)
+
+// Peer discovery constants
+const (
+	PEER_DISCOVERY_MAX_AMOUNT = 100
+	PEER_DISCOVERY_MAX_TIME   = 2 * time.Second
+
+	// Documents are sampled before they are filtered, so more are sampled than asked for,
+	// over a few rounds if too few of them match
+	PEER_DISCOVERY_OVERSAMPLE    = 4
+	PEER_DISCOVERY_SAMPLE_ROUNDS = 3
+)
+
+// File versioning constants
+const (
+	FILE_VERSIONS_DEFAULT = 5 // versions kept of each file unless the user chooses otherwise
+	FILE_VERSIONS_MAX     = 100
+
+	// Concurrent uploads of a file can pick the same version number; the unique index
+	// rejects all but one, and the others are renumbered and tried again
+	FILE_VERSION_INDEX_NAME      = "file_version_unique"
+	FILE_VERSION_INSERT_ATTEMPTS = 5
+)
+
+// File expiry constants
+const (
+	EXPIRY_SWEEP_INTERVAL = 10 * time.Minute // override with SHR_EXPIRY_SWEEP_INTERVAL
+
+	PURGE_PENDING   = "pending"
+	PURGE_CONFIRMED = "confirmed"
+
+	PURGE_RETENTION = 7 * 24 * time.Hour // how long purges are kept for hosts to pick up
+)
+
+// Trash constants
+const (
+	TRASH_RETENTION      = 30 * 24 * time.Hour // override with SHR_TRASH_RETENTION
+	TRASH_PURGE_INTERVAL = 1 * time.Hour
+)
+
+// Tier migration constants
+const (
+	MIGRATION_PENDING   = "pending"
+	MIGRATION_COMPLETED = "completed"
+	MIGRATION_FAILED    = "failed"
+
+	MIGRATION_PLAN_INTERVAL  = 30 * time.Minute // override with SHR_MIGRATION_PLAN_INTERVAL
+	MIGRATION_JOB_TIMEOUT    = 24 * time.Hour
+	MIGRATION_JOBS_PER_ROUND = 20
+
+	// Storage pool utilisation (0-1) above which files move out to AWS, below which they
+	// move back, and which either kind of move aims for
+	MIGRATION_SPOOL_HIGH_WATER = 0.9
+	MIGRATION_SPOOL_LOW_WATER  = 0.7
+	MIGRATION_SPOOL_TARGET     = 0.8
+)
+
+// Object store constants
+const (
+	OBJECT_URL_EXPIRY = 1 * time.Hour // how long pre-signed upload and download URLs work for
+)
+
+// Rendezvous constants
+const (
+	RENDEZVOUS_STAGE_DIRECT = "direct"
+	RENDEZVOUS_STAGE_RELAY  = "relay"
+
+	RENDEZVOUS_PENDING   = "pending"
+	RENDEZVOUS_CONNECTED = "connected"
+	RENDEZVOUS_FAILED    = "failed"
+
+	RENDEZVOUS_INTRODUCTION_TTL = 2 * time.Minute // per stage
+)
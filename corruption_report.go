@@ -0,0 +1,18 @@
+package main
+
+// CorruptionReport records a client finding that a shard it downloaded from a host does
+// not match the shard's hash. The host is challenged for the shard, and replaced as a
+// holder of it by a repair if it fails.
+type CorruptionReport struct {
+	ID           string `bson:"id" json:"id"`
+	FileID       string `bson:"file_id" json:"file_id"`
+	FileName     string `bson:"file_name" json:"file_name"`
+	ShardIndex   int    `bson:"shard_index" json:"shard_index"`
+	Host         string `bson:"host" json:"host"`
+	Reporter     string `bson:"reporter" json:"reporter"` // username of the client that downloaded the shard
+	ExpectedHash string `bson:"expected_hash" json:"expected_hash"`
+	ActualHash   string `bson:"actual_hash" json:"actual_hash"`
+	ChallengeID  string `bson:"challenge_id" json:"challenge_id"`
+	RepairJobID  string `bson:"repair_job_id,omitempty" json:"repair_job_id,omitempty"` // set once the host fails the challenge
+	CreatedAt    int64  `bson:"created_at" json:"created_at"`                           // in unix time
+}
@@ -0,0 +1,13 @@
+package main
+
+// CreditLedgerEntry records a change to a user's credit balance: credits earned for
+// hosting other users' shards, or spent on the user's own storage pool usage.
+type CreditLedgerEntry struct {
+	ID          string  `bson:"id" json:"id"`
+	UserName    string  `bson:"user_name" json:"user_name"`
+	Kind        string  `bson:"kind" json:"kind"`
+	GBHours     float64 `bson:"gb_hours" json:"gb_hours"`
+	Amount      float64 `bson:"amount" json:"amount"`             // negative when credits are spent
+	PeriodStart int64   `bson:"period_start" json:"period_start"` // in unix time
+	PeriodEnd   int64   `bson:"period_end" json:"period_end"`     // in unix time
+}
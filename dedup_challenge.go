@@ -0,0 +1,26 @@
+package main
+
+// DedupChallenge asks an uploader claiming content that may already be stored to prove
+// they hold it, by returning some of its shards' chunks, picked at random, with their
+// Merkle proofs. It is issued whether or not the content is stored, so that asking for
+// one reveals nothing about what other users have uploaded to a node that knows the
+// content's chunk counts.
+type DedupChallenge struct {
+	ID          string           `bson:"id" json:"id"`
+	UserName    string           `bson:"user_name" json:"user_name"`
+	ContentHash string           `bson:"content_hash" json:"content_hash"`
+	Leaves      []ChallengedLeaf `bson:"leaves" json:"leaves"`
+	ExpiresAt   int64            `bson:"expires_at" json:"expires_at"` // in unix time
+}
+
+// ChallengedLeaf is a chunk of a shard the uploader must return.
+type ChallengedLeaf struct {
+	ShardIndex int `bson:"shard_index" json:"shard_index"`
+	LeafIndex  int `bson:"leaf_index" json:"leaf_index"`
+}
+
+// LeafProof answers a ChallengedLeaf with the chunk and its Merkle proof.
+type LeafProof struct {
+	Chunk []byte   `json:"chunk"` // base64 in JSON
+	Proof []string `json:"proof"` // hex sibling hashes, see VerifyMerkleProof
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Files with the same content hash and shard layout share their storage. The first such
+// file is the primary: it holds the hosts and shard metadata and counts how many files
+// (itself included) refer to the content in RefCount. Later files are references with no
+// hosts of their own.
+//
+// Every file is charged to its uploader's usage in full, but the network counters only
+// count the content once. Capacity is freed when the last file referring to it goes.
+//
+// A content hash alone proves nothing, since anyone who learns it could otherwise record
+// a reference and be handed the content's hosts. An uploader must first answer a
+// DedupChallenge over the shards' Merkle trees, so only content stored with Merkle roots
+// is deduplicated. Uploads that do not prove possession are stored on their own.
+
+// FindContentPrimary returns the primary file holding the given content with the given
+// shard layout. found is false if the content is not stored yet.
+func FindContentPrimary(contentHash string, shards int, backupShards int) (primary UploadedFile, found bool, err error) {
+	filter := bson.D{
+		{Key: "content_hash", Value: contentHash},
+		{Key: "is_reference", Value: false},
+		{Key: "shards", Value: shards},
+		{Key: "backup_shards", Value: backupShards},
+	}
+
+	if err := uploadedFilesColl.FindOne(context.Background(), filter).Decode(&primary); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return UploadedFile{}, false, nil
+		}
+		return UploadedFile{}, false, err
+	}
+
+	return primary, true, nil
+}
+
+// IssueDedupChallenge challenges the user to return random chunks of the shards of the
+// content with the given shard layout. The chunks are picked from the stored content's
+// shards, so the chunk counts the user claims only matter when the content is not stored
+// and the challenge cannot be answered anyway.
+func IssueDedupChallenge(username string, contentHash string, shards int, backupShards int, claimedLeafCounts []int) (DedupChallenge, error) {
+	if len(claimedLeafCounts) == 0 {
+		return DedupChallenge{}, fmt.Errorf("no shard chunk counts given")
+	}
+	for _, count := range claimedLeafCounts {
+		if count <= 0 {
+			return DedupChallenge{}, fmt.Errorf("shard chunk counts must be positive")
+		}
+	}
+
+	leafCounts := claimedLeafCounts
+	if primary, found, err := FindContentPrimary(contentHash, shards, backupShards); err != nil {
+		return DedupChallenge{}, err
+	} else if found && len(primary.ShardLeafCounts) > 0 {
+		leafCounts = primary.ShardLeafCounts
+	}
+
+	challenge := DedupChallenge{
+		ID:          primitive.NewObjectID().Hex(),
+		UserName:    username,
+		ContentHash: contentHash,
+		ExpiresAt:   time.Now().Add(DEDUP_CHALLENGE_TIMEOUT).Unix(),
+	}
+
+	// The chunks must not be predictable, or the answers could be fetched in advance
+	leaves, err := pickChallengedLeaves(leafCounts, DEDUP_CHALLENGE_LEAVES)
+	if err != nil {
+		return DedupChallenge{}, err
+	}
+	challenge.Leaves = leaves
+
+	expired := bson.D{{Key: "expires_at", Value: bson.D{{Key: "$lt", Value: time.Now().Unix()}}}}
+	if _, err := dedupChallengesColl.DeleteMany(context.Background(), expired); err != nil {
+		log.Println("Unable to delete expired dedup challenges:", err)
+	}
+
+	if _, err := dedupChallengesColl.InsertOne(context.Background(), challenge); err != nil {
+		return DedupChallenge{}, err
+	}
+
+	return challenge, nil
+}
+
+// pickChallengedLeaves picks n chunks at random from shards with the given chunk counts.
+func pickChallengedLeaves(leafCounts []int, n int) ([]ChallengedLeaf, error) {
+	leaves := make([]ChallengedLeaf, 0, n)
+	for i := 0; i < n; i++ {
+		shardIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(leafCounts))))
+		if err != nil {
+			return nil, err
+		}
+		leafIndex, err := rand.Int(rand.Reader, big.NewInt(int64(leafCounts[shardIndex.Int64()])))
+		if err != nil {
+			return nil, err
+		}
+
+		leaves = append(leaves, ChallengedLeaf{ShardIndex: int(shardIndex.Int64()), LeafIndex: int(leafIndex.Int64())})
+	}
+
+	return leaves, nil
+}
+
+// ProveContentPossession checks the user's answers to their challenge against the Merkle
+// roots of the primary's shards. A challenge can only be answered once.
+func ProveContentPossession(id string, username string, primary UploadedFile, proofs []LeafProof) (bool, error) {
+	filter := bson.D{
+		{Key: "id", Value: id},
+		{Key: "user_name", Value: username},
+		{Key: "content_hash", Value: primary.ContentHash},
+		{Key: "expires_at", Value: bson.D{{Key: "$gte", Value: time.Now().Unix()}}},
+	}
+
+	var challenge DedupChallenge
+	if err := dedupChallengesColl.FindOneAndDelete(context.Background(), filter).Decode(&challenge); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if len(proofs) != len(challenge.Leaves) {
+		return false, nil
+	}
+
+	for i, leaf := range challenge.Leaves {
+		if leaf.ShardIndex >= len(primary.ShardMerkleRoots) || leaf.ShardIndex >= len(primary.ShardLeafCounts) {
+			return false, nil
+		}
+
+		root, leafCount := primary.ShardMerkleRoots[leaf.ShardIndex], primary.ShardLeafCounts[leaf.ShardIndex]
+		if err := VerifyMerkleProof(root, leafCount, leaf.LeafIndex, proofs[i].Chunk, proofs[i].Proof); err != nil {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// InsertFileReference records the file as a reference to the primary's content and
+// charges it to the uploader's usage, without using any more network capacity.
+func InsertFileReference(file UploadedFile, primary UploadedFile) error {
+	file.IsReference = true
+	file.RefCount = 0
+	file.Hosts = nil
+	file.ShardMerkleRoots = nil
+	file.ShardLeafCounts = nil
+	file.ShardHashes = nil
+	file.ErasureCoding = nil
+	file.ObjectKey = ""
+	file.FileSize = primary.FileSize
+	file.InStoragePool = primary.InStoragePool
+
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "ref_count", Value: 1}}}}
+	if _, err := uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: primary.ID}}, update); err != nil {
+		return err
+	}
+
+	if err := InsertUploadedFile(file); err != nil {
+		uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: primary.ID}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "ref_count", Value: -1}}}})
+		return err
+	}
+
+	return AdjustUserUsage(file.UploaderUsername, file.InStoragePool, file.FileSize, 1)
+}
+
+// ResolveFileContent returns the file with the hosts and shard metadata of the content it
+// refers to filled in. Files that are not references are returned unchanged.
+func ResolveFileContent(file UploadedFile) (UploadedFile, error) {
+	if !file.IsReference {
+		return file, nil
+	}
+
+	primary, found, err := FindContentPrimary(file.ContentHash, file.Shards, file.BackupShards)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	if !found {
+		return UploadedFile{}, fmt.Errorf("content of file %v is missing", file.FileName)
+	}
+
+	file.Hosts = primary.Hosts
+	file.ShardMerkleRoots = primary.ShardMerkleRoots
+	file.ShardLeafCounts = primary.ShardLeafCounts
+	file.FileHash = primary.FileHash
+	file.ShardHashes = primary.ShardHashes
+	file.ErasureCoding = primary.ErasureCoding
+	file.ObjectKey = primary.ObjectKey
+
+	return file, nil
+}
+
+// promoteReference turns the reference into the primary of the content in place of the
+// given primary, which is about to be removed. The reference keeps its own identity but
+// takes over the primary's hosts, shard metadata and object.
+func promoteReference(primary UploadedFile, reference UploadedFile) error {
+	// Object keys are unique, so the primary gives its up first
+	if primary.ObjectKey != "" {
+		update := bson.D{{Key: "$unset", Value: bson.D{{Key: "object_key", Value: ""}}}}
+		if _, err := uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: primary.ID}}, update); err != nil {
+			return err
+		}
+	}
+
+	promoted := primary
+	promoted.ID = reference.ID
+	promoted.FileName = reference.FileName
+	promoted.Folder = reference.Folder
+	promoted.UploadDate = reference.UploadDate
+	promoted.UploaderUsername = reference.UploaderUsername
+	promoted.IsMonthlySub = reference.IsMonthlySub
+	promoted.Timezone = reference.Timezone
+	promoted.Version = reference.Version
+	promoted.IsLatest = reference.IsLatest
+	promoted.ExpiresAt = reference.ExpiresAt
+	promoted.TrashedAt = reference.TrashedAt
+	promoted.IsReference = false
+	promoted.RefCount = primary.RefCount - 1
+
+	_, err := uploadedFilesColl.ReplaceOne(context.Background(), bson.D{{Key: "_id", Value: reference.ID}}, promoted)
+	return err
+}
+
+// RemoveUploadedFile deletes the file record and reverses its capacity accounting. The
+// uploader's usage always goes down by the file's size; the network's used capacity only
+// goes down when no other file refers to the same content.
+func RemoveUploadedFile(file UploadedFile) error {
+	freesCapacity := true
+
+	if file.IsReference {
+		freesCapacity = false
+
+		if primary, found, err := FindContentPrimary(file.ContentHash, file.Shards, file.BackupShards); err != nil {
+			return err
+		} else if found {
+			update := bson.D{{Key: "$inc", Value: bson.D{{Key: "ref_count", Value: -1}}}}
+			if _, err := uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: primary.ID}}, update); err != nil {
+				return err
+			}
+		}
+	} else if file.ContentHash != "" && file.RefCount > 1 {
+		filter := bson.D{
+			{Key: "content_hash", Value: file.ContentHash},
+			{Key: "is_reference", Value: true},
+			{Key: "shards", Value: file.Shards},
+			{Key: "backup_shards", Value: file.BackupShards},
+		}
+
+		var reference UploadedFile
+		if err := uploadedFilesColl.FindOne(context.Background(), filter).Decode(&reference); err == nil {
+			if err := promoteReference(file, reference); err != nil {
+				return err
+			}
+			freesCapacity = false
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+
+	if err := deleteUploadedFileByID(file); err != nil {
+		return err
+	}
+
+	if freesCapacity {
+		var err error
+		if file.InStoragePool {
+			_, err = DecrementStoragePoolUsed(file.FileSize)
+		} else {
+			_, err = DecrementAwsStorageUsed(file.FileSize)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Nothing refers to the shards any more, so the hosts can reclaim the space
+		if err := PlanShardPurges(file, "file deleted"); err != nil {
+			log.Println("Unable to ask hosts to purge shards:", err)
+		}
+		deleteStoredObject(file.ObjectKey)
+	}
+
+	return AdjustUserUsage(file.UploaderUsername, file.InStoragePool, -file.FileSize, -1)
+}
+
+// sumReferencedCapacity returns the storage pool and AWS capacity charged to users for
+// references, which the network counters do not include.
+func sumReferencedCapacity() (float64, float64, error) {
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "is_reference", Value: true}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$in_storage_pool"},
+			{Key: "size", Value: bson.D{{Key: "$sum", Value: "$file_size"}}},
+		}}},
+	}
+
+	cursor, err := uploadedFilesColl.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var results []struct {
+		InStoragePool bool    `bson:"_id"`
+		Size          float64 `bson:"size"`
+	}
+	if err := cursor.All(context.Background(), &results); err != nil {
+		return 0, 0, err
+	}
+
+	var spool, aws float64
+	for _, result := range results {
+		if result.InStoragePool {
+			spool = result.Size
+		} else {
+			aws = result.Size
+		}
+	}
+
+	return spool, aws, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestPickChallengedLeaves(t *testing.T) {
+	leafCounts := []int{3, 1, 50}
+
+	leaves, err := pickChallengedLeaves(leafCounts, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 200 {
+		t.Fatalf("picked %v leaves, want 200", len(leaves))
+	}
+
+	picked := make(map[ChallengedLeaf]bool)
+	for _, leaf := range leaves {
+		if leaf.ShardIndex < 0 || leaf.ShardIndex >= len(leafCounts) {
+			t.Fatalf("shard index %v out of range", leaf.ShardIndex)
+		}
+		if leaf.LeafIndex < 0 || leaf.LeafIndex >= leafCounts[leaf.ShardIndex] {
+			t.Fatalf("leaf index %v out of range for shard %v", leaf.LeafIndex, leaf.ShardIndex)
+		}
+		picked[leaf] = true
+	}
+
+	// 200 picks from 54 leaves landing on only a few of them would mean they are predictable
+	if len(picked) < 20 {
+		t.Errorf("only %v distinct leaves picked", len(picked))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunExpirySweeper deletes the expired files, and forgets old shard purges, every interval.
+func RunExpirySweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if expired, err := ExpireFiles(time.Now().Unix()); err != nil {
+			log.Println("Unable to delete expired files:", err)
+		} else if expired > 0 {
+			log.Printf("Deleted %v expired files\n", expired)
+		}
+
+		if err := deleteOldShardPurges(); err != nil {
+			log.Println("Unable to delete old shard purges:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// ExpireFiles deletes every file version whose expiry has passed, reversing its capacity
+// accounting and asking its hosts to purge the shards. It returns the number deleted.
+func ExpireFiles(now int64) (int, error) {
+	filter := bson.D{{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: 0}, {Key: "$lte", Value: now}}}}
+
+	// Oldest versions first, so that a file's latest version is handed on to a version
+	// that is being kept
+	cursor, err := uploadedFilesColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "version", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, file := range files {
+		file, found, err := reloadUploadedFile(file)
+		if err != nil {
+			return expired, err
+		} else if !found {
+			continue
+		}
+
+		if err := RemoveFileVersion(file); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	return expired, nil
+}
+
+// SetFileExpiry sets when every version of the user's file expires. An expiry of 0 keeps
+// the file until it is deleted.
+func SetFileExpiry(username string, folder string, fileName string, expiresAt int64) error {
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return fmt.Errorf("expiry is in the past")
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: expiresAt}}}}
+	if result, err := uploadedFilesColl.UpdateMany(context.Background(), fileFilter(username, folder, fileName), update); err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return fmt.Errorf("file not found")
+	}
+
+	return nil
+}
+
+// retentionFor returns the retention (in seconds) of the user's most specific rule
+// covering the folder, or 0 if no rule covers it.
+func retentionFor(user User, folder string) int64 {
+	folder = CleanFolderPath(folder)
+
+	var retention int64
+	matched := ""
+	for _, rule := range user.RetentionRules {
+		covers := rule.Folder == "/" || rule.Folder == folder || strings.HasPrefix(folder, rule.Folder+"/")
+		if covers && len(rule.Folder) >= len(matched) {
+			retention = rule.Retention
+			matched = rule.Folder
+		}
+	}
+
+	return retention
+}
+
+// DefaultFileExpiry returns when a file the user records now in the folder expires under
+// their retention rules, or 0 if it does not.
+func DefaultFileExpiry(username string, folder string, now int64) (int64, error) {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return 0, err
+	}
+
+	if retention := retentionFor(user, folder); retention > 0 {
+		return now + retention, nil
+	}
+
+	return 0, nil
+}
+
+// SetRetentionRule sets the retention of the user's files in the folder. A retention of 0
+// removes the folder's rule.
+func SetRetentionRule(username string, folder string, retention int64) error {
+	folder = CleanFolderPath(folder)
+	if retention < 0 {
+		return fmt.Errorf("retention cannot be negative")
+	}
+
+	filter := bson.D{{Key: "user_name", Value: username}}
+	remove := bson.D{{Key: "$pull", Value: bson.D{{Key: "retention_rules", Value: bson.D{{Key: "folder", Value: folder}}}}}}
+	if result, err := userDetailsColl.UpdateOne(context.Background(), filter, remove); err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	if retention == 0 {
+		return nil
+	}
+
+	add := bson.D{{Key: "$push", Value: bson.D{{Key: "retention_rules", Value: RetentionRule{Folder: folder, Retention: retention}}}}}
+	_, err := userDetailsColl.UpdateOne(context.Background(), filter, add)
+	return err
+}
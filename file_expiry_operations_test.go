@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestRetentionFor(t *testing.T) {
+	user := User{RetentionRules: []RetentionRule{
+		{Folder: "/", Retention: 100},
+		{Folder: "/photos", Retention: 200},
+		{Folder: "/photos/raw", Retention: 300},
+	}}
+
+	tests := []struct {
+		name   string
+		user   User
+		folder string
+		want   int64
+	}{
+		{"root rule", user, "/", 100},
+		{"empty folder is the root", user, "", 100},
+		{"uncovered folder falls back to the root", user, "/docs", 100},
+		{"exact folder", user, "/photos", 200},
+		{"trailing slash", user, "/photos/", 200},
+		{"subfolder", user, "/photos/2024", 200},
+		{"most specific rule", user, "/photos/raw/june", 300},
+		{"prefix is not a parent", user, "/photoshop", 100},
+		{"no rules", User{}, "/photos", 0},
+		{"no covering rule", User{RetentionRules: []RetentionRule{{Folder: "/photos", Retention: 200}}}, "/docs", 0},
+	}
+
+	for _, test := range tests {
+		if got := retentionFor(test.user, test.folder); got != test.want {
+			t.Errorf("%v: retentionFor(%q) = %v, want %v", test.name, test.folder, got, test.want)
+		}
+	}
+}
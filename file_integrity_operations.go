@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// validateIntegrityMetadata checks that the file's integrity metadata, if given, covers
+// every shard and agrees with the file's shard layout.
+func validateIntegrityMetadata(file UploadedFile) error {
+	if file.ShardHashes != nil && len(file.ShardHashes) != len(file.Hosts) {
+		return fmt.Errorf("a hash is needed for every shard")
+	}
+
+	if coding := file.ErasureCoding; coding != nil {
+		if coding.DataShards <= 0 || coding.ParityShards < 0 {
+			return fmt.Errorf("invalid erasure coding shard counts")
+		}
+		if coding.DataShards+coding.ParityShards != len(file.Hosts) {
+			return fmt.Errorf("erasure coding shard counts do not match the number of shards")
+		}
+	}
+
+	return nil
+}
+
+// ReportShardCorruption records that the copy of a shard the reporter downloaded from the
+// host did not hash to the shard's recorded hash. The report alone is not trusted: the host
+// is challenged to prove it holds the shard, and only if it fails is a repair replacing it
+// planned (see confirmCorruptionReports).
+func ReportShardCorruption(file UploadedFile, shardIndex int, host string, reporter string, actualHash string) (CorruptionReport, error) {
+	// The hosts and hashes of deduplicated files belong to the file storing the content
+	if file.IsReference {
+		primary, found, err := FindContentPrimary(file.ContentHash, file.Shards, file.BackupShards)
+		if err != nil {
+			return CorruptionReport{}, err
+		}
+		if !found {
+			return CorruptionReport{}, fmt.Errorf("content of file %v is missing", file.FileName)
+		}
+		file = primary
+	}
+
+	if shardIndex < 0 || shardIndex >= len(file.Hosts) {
+		return CorruptionReport{}, fmt.Errorf("invalid shard index %v", shardIndex)
+	}
+	if shardIndex >= len(file.ShardHashes) {
+		return CorruptionReport{}, fmt.Errorf("file has no hash for shard %v", shardIndex)
+	}
+
+	expectedHash := file.ShardHashes[shardIndex]
+	if strings.EqualFold(expectedHash, actualHash) {
+		return CorruptionReport{}, fmt.Errorf("reported hash matches the shard's hash")
+	}
+
+	holdsShard := false
+	for _, address := range file.Hosts[shardIndex] {
+		if address == host {
+			holdsShard = true
+		}
+	}
+	if !holdsShard {
+		return CorruptionReport{}, fmt.Errorf("host %v does not hold shard %v", host, shardIndex)
+	}
+	if shardIndex >= len(file.ShardMerkleRoots) || shardIndex >= len(file.ShardLeafCounts) || file.ShardLeafCounts[shardIndex] <= 0 {
+		return CorruptionReport{}, fmt.Errorf("shard %v has no Merkle root, so the report cannot be confirmed", shardIndex)
+	}
+
+	// Reports of the same shard and host share one challenge until it is answered
+	var challenge StorageChallenge
+	pending := bson.D{
+		{Key: "file_id", Value: file.ID.Hex()},
+		{Key: "shard_index", Value: shardIndex},
+		{Key: "host", Value: host},
+		{Key: "status", Value: CHALLENGE_PENDING},
+	}
+	if err := storageChallengesColl.FindOne(context.Background(), pending).Decode(&challenge); err == mongo.ErrNoDocuments {
+		if challenge, err = issueStorageChallenge(file, shardIndex, host); err != nil {
+			return CorruptionReport{}, err
+		}
+	} else if err != nil {
+		return CorruptionReport{}, err
+	}
+
+	report := CorruptionReport{
+		ID:           primitive.NewObjectID().Hex(),
+		FileID:       file.ID.Hex(),
+		FileName:     file.FileName,
+		ShardIndex:   shardIndex,
+		Host:         host,
+		Reporter:     reporter,
+		ExpectedHash: expectedHash,
+		ActualHash:   actualHash,
+		ChallengeID:  challenge.ID,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	if _, err := corruptionReportsColl.InsertOne(context.Background(), report); err != nil {
+		return CorruptionReport{}, err
+	}
+
+	return report, nil
+}
+
+// confirmCorruptionReports links the reports that led to the challenge to the repair
+// planned after the host failed it.
+func confirmCorruptionReports(challenge StorageChallenge, job RepairJob, created bool) error {
+	filter := bson.D{{Key: "challenge_id", Value: challenge.ID}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "repair_job_id", Value: job.ID}}}}
+	result, err := corruptionReportsColl.UpdateMany(context.Background(), filter, update)
+	if err != nil {
+		return err
+	}
+
+	// Several clients may report the same corrupt shard, the host is only counted once
+	if result.MatchedCount > 0 && created {
+		incrementHostCounter(challenge.Host, "corrupt_shards")
+	}
+
+	return nil
+}
+
+// GetCorruptionReports returns the corruption reports made against the file's shards.
+func GetCorruptionReports(fileID string) ([]CorruptionReport, error) {
+	cursor, err := corruptionReportsColl.Find(context.Background(), bson.D{{Key: "file_id", Value: fileID}})
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []CorruptionReport{}
+	if err := cursor.All(context.Background(), &reports); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func InsertUploadedFile(uploadedFile UploadedFile) error {
@@ -12,24 +14,71 @@ func InsertUploadedFile(uploadedFile UploadedFile) error {
 		return err
 	} else {
 		fmt.Println("Inserted a single document: ", result.InsertedID)
+		EmitWebhookEvent(EVENT_FILE_UPLOADED, uploadedFile)
 		return nil
 	}
 }
 
-func GetUploadedFileByFileName(fileName string) (UploadedFile, error) {
-	filter := bson.D{{Key: "file_name", Value: fileName}}
+// getUploadedFileByID returns the uploaded file with the given (hex) ID.
+func getUploadedFileByID(id string) (UploadedFile, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+
+	var result UploadedFile
+	if err := uploadedFilesColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: objectID}}).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return UploadedFile{}, fmt.Errorf("file not found")
+		}
+		return UploadedFile{}, err
+	}
+	return result, nil
+}
+
+// reloadUploadedFile re-reads the file's record. Removing a primary promotes one of its
+// references in place (see promoteReference), so a record read before a batch of removals
+// may be out of date by the time its turn comes. found is false if the record is gone.
+func reloadUploadedFile(file UploadedFile) (UploadedFile, bool, error) {
+	var result UploadedFile
+	if err := uploadedFilesColl.FindOne(context.Background(), bson.D{{Key: "_id", Value: file.ID}}).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return UploadedFile{}, false, nil
+		}
+		return UploadedFile{}, false, err
+	}
+	return result, true, nil
+}
+
+// removeUploadedFileIfPresent removes the file as it is now recorded, for callers removing
+// several files read before the first removal, which may have promoted one of the others.
+func removeUploadedFileIfPresent(file UploadedFile) error {
+	file, found, err := reloadUploadedFile(file)
+	if err != nil || !found {
+		return err
+	}
+
+	return RemoveUploadedFile(file)
+}
 
+// GetUploadedFile returns the latest version of the file with the given folder and name uploaded by the user.
+func GetUploadedFile(username string, folder string, fileName string) (UploadedFile, error) {
 	var result UploadedFile
-	if err := uploadedFilesColl.FindOne(context.Background(), filter).Decode(&result); err != nil {
+	if err := uploadedFilesColl.FindOne(context.Background(), latestVersionFilter(username, folder, fileName)).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return UploadedFile{}, fmt.Errorf("file not found")
+		}
 		return UploadedFile{}, err
 	}
 	return result, nil
 }
 
-func DeleteUploadedFileByFileName(fileName string) error {
-	filter := bson.D{{Key: "file_name", Value: fileName}}
-	if _, err := uploadedFilesColl.DeleteOne(context.Background(), filter); err != nil {
+// deleteUploadedFileByID deletes the file's record, leaving capacity accounting to the caller.
+func deleteUploadedFileByID(file UploadedFile) error {
+	if result, err := uploadedFilesColl.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: file.ID}}); err != nil {
 		return err
+	} else if result.DeletedCount > 0 {
+		EmitWebhookEvent(EVENT_FILE_DELETED, file)
 	}
-	return nil
+	return deleteKeyEnvelopes(file.ID.Hex())
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Recording a file under a name the user already has creates a new version of it. Every
+// version keeps its own hosts, size and upload date and is charged to the user until it
+// is pruned. Files recorded before versioning have no version number and count as the
+// latest (and only) version of their name.
+
+// latestVersionFilter matches the latest version of the user's file with the given folder and name.
+func latestVersionFilter(username string, folder string, fileName string) bson.D {
+	return append(fileFilter(username, folder, fileName), bson.E{Key: "is_latest", Value: bson.D{{Key: "$ne", Value: false}}})
+}
+
+// assignFileVersion numbers the file as the next version of the user's file with its name
+// and marks it as the latest one. Versions in the trash are counted too, so that version
+// numbers are never reused.
+func assignFileVersion(file *UploadedFile) error {
+	// The ID tells the new version apart from the earlier ones in retireFileVersions
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+	file.Version = 1
+	file.IsLatest = true
+
+	filter := bson.D{
+		{Key: "uploader_username", Value: file.UploaderUsername},
+		folderMatch(CleanFolderPath(file.Folder)),
+		{Key: "file_name", Value: file.FileName},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+
+	var latest UploadedFile
+	if err := uploadedFilesColl.FindOne(context.Background(), filter, opts).Decode(&latest); err == nil {
+		file.Version = nextFileVersion(latest.Version)
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	return nil
+}
+
+// nextFileVersion returns the version number that follows the file's highest one. A file
+// recorded before versioning has no number and counts as version 1.
+func nextFileVersion(highest int) int {
+	if highest <= 0 {
+		return 2
+	}
+
+	return highest + 1
+}
+
+// insertFileVersion numbers the file as the next version of its name and records it with
+// insert. If a concurrent upload of the same name took the number first, the file is
+// renumbered and recorded again.
+func insertFileVersion(file *UploadedFile, insert func(UploadedFile) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := assignFileVersion(file); err != nil {
+			return err
+		}
+
+		err := insert(*file)
+		if err == nil || !isVersionConflict(err) || attempt == FILE_VERSION_INSERT_ATTEMPTS {
+			return err
+		}
+	}
+}
+
+// isVersionConflict reports whether the error is another record already having the
+// file's version number.
+func isVersionConflict(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == 11000 && strings.Contains(e.Message, FILE_VERSION_INDEX_NAME) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retireFileVersions is called once a new version of the file has been recorded. The
+// earlier versions stop being the latest, and the oldest are deleted (with their capacity
+// reversed) so that the user keeps no more versions than their setting allows. A later
+// version recorded concurrently stays the latest.
+func retireFileVersions(file UploadedFile) error {
+	filter := append(latestVersionFilter(file.UploaderUsername, file.Folder, file.FileName),
+		bson.E{Key: "_id", Value: bson.D{{Key: "$ne", Value: file.ID}}},
+		bson.E{Key: "version", Value: bson.D{{Key: "$lt", Value: file.Version}}})
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "is_latest", Value: false}}}}
+	if _, err := uploadedFilesColl.UpdateMany(context.Background(), filter, update); err != nil {
+		return err
+	}
+
+	// If a later version was recorded first, it retired the earlier ones, but not this one
+	later := append(fileFilter(file.UploaderUsername, file.Folder, file.FileName),
+		bson.E{Key: "version", Value: bson.D{{Key: "$gt", Value: file.Version}}})
+	if count, err := uploadedFilesColl.CountDocuments(context.Background(), later); err != nil {
+		return err
+	} else if count > 0 {
+		if _, err := uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: file.ID}}, update); err != nil {
+			return err
+		}
+	}
+
+	return pruneFileVersions(file.UploaderUsername, file.Folder, file.FileName)
+}
+
+// pruneFileVersions deletes the oldest versions of the user's file, with their capacity
+// reversed, so that the user keeps no more versions than their setting allows.
+func pruneFileVersions(username string, folder string, fileName string) error {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	versions, err := GetFileVersions(username, folder, fileName)
+	if err != nil {
+		return err
+	}
+
+	for i := user.VersionsToKeep(); i < len(versions); i++ {
+		if err := removeUploadedFileIfPresent(versions[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resetLatestFileVersion makes the newest version of the user's file the latest one and
+// prunes the versions beyond the user's setting, as after versions come back from the trash.
+func resetLatestFileVersion(username string, folder string, fileName string) error {
+	if err := markLatestFileVersion(username, folder, fileName); err != nil {
+		return err
+	}
+
+	return pruneFileVersions(username, folder, fileName)
+}
+
+// markLatestFileVersion makes the newest version of the user's file the latest one.
+func markLatestFileVersion(username string, folder string, fileName string) error {
+	var newest UploadedFile
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+	if err := uploadedFilesColl.FindOne(context.Background(), fileFilter(username, folder, fileName), opts).Decode(&newest); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+
+	older := append(fileFilter(username, folder, fileName), bson.E{Key: "_id", Value: bson.D{{Key: "$ne", Value: newest.ID}}})
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "is_latest", Value: false}}}}
+	if _, err := uploadedFilesColl.UpdateMany(context.Background(), older, update); err != nil {
+		return err
+	}
+
+	update = bson.D{{Key: "$set", Value: bson.D{{Key: "is_latest", Value: true}}}}
+	_, err := uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: newest.ID}}, update)
+	return err
+}
+
+// GetFileVersions returns every retained version of the user's file, newest first.
+func GetFileVersions(username string, folder string, fileName string) ([]UploadedFile, error) {
+	cursor, err := uploadedFilesColl.Find(context.Background(), fileFilter(username, folder, fileName), options.Find().SetSort(bson.D{{Key: "version", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []UploadedFile{}
+	if err := cursor.All(context.Background(), &versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// GetFileVersion returns the given version of the user's file.
+func GetFileVersion(username string, folder string, fileName string, version int) (UploadedFile, error) {
+	filter := append(fileFilter(username, folder, fileName), bson.E{Key: "version", Value: version})
+
+	var result UploadedFile
+	if err := uploadedFilesColl.FindOne(context.Background(), filter).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return UploadedFile{}, fmt.Errorf("version %v of file %v not found", version, fileName)
+		}
+		return UploadedFile{}, err
+	}
+	return result, nil
+}
+
+// RemoveFileVersion deletes one version of a file. If it was the latest version, the
+// version before it becomes the latest.
+func RemoveFileVersion(file UploadedFile) error {
+	if err := RemoveUploadedFile(file); err != nil {
+		return err
+	}
+
+	if !file.IsLatest {
+		return nil
+	}
+
+	filter := fileFilter(file.UploaderUsername, file.Folder, file.FileName)
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "is_latest", Value: true}}}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "version", Value: -1}})
+	if err := uploadedFilesColl.FindOneAndUpdate(context.Background(), filter, update, opts).Err(); err == mongo.ErrNoDocuments {
+		// That was the only version, so the file is gone
+		return deleteShareGrants(file.UploaderUsername, file.Folder, file.FileName)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveAllFileVersions deletes every version of the user's file.
+func RemoveAllFileVersions(username string, folder string, fileName string) error {
+	versions, err := GetFileVersions(username, folder, fileName)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("file not found")
+	}
+
+	for _, version := range versions {
+		if err := removeUploadedFileIfPresent(version); err != nil {
+			return err
+		}
+	}
+
+	return deleteShareGrants(username, folder, fileName)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNextFileVersion(t *testing.T) {
+	tests := []struct {
+		highest int
+		want    int
+	}{
+		{0, 2}, // recorded before versioning, counts as version 1
+		{1, 2},
+		{5, 6},
+	}
+
+	for _, test := range tests {
+		if got := nextFileVersion(test.highest); got != test.want {
+			t.Errorf("nextFileVersion(%v) = %v, want %v", test.highest, got, test.want)
+		}
+	}
+}
+
+func TestIsVersionConflict(t *testing.T) {
+	duplicate := func(message string) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: message}}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"version index", duplicate("E11000 duplicate key error collection: uploaded-files index: " + FILE_VERSION_INDEX_NAME + " dup key"), true},
+		{"wrapped", fmt.Errorf("insert: %w", duplicate("index: "+FILE_VERSION_INDEX_NAME)), true},
+		{"another index", duplicate("E11000 duplicate key error collection: uploaded-files index: object_key_1 dup key"), false},
+		{"another code", mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121, Message: FILE_VERSION_INDEX_NAME}}}, false},
+		{"not a write error", fmt.Errorf("%v", FILE_VERSION_INDEX_NAME), false},
+	}
+
+	for _, test := range tests {
+		if got := isVersionConflict(test.err); got != test.want {
+			t.Errorf("%v: isVersionConflict() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVersionsToKeep(t *testing.T) {
+	tests := []struct {
+		versionsKept int
+		want         int
+	}{
+		{0, FILE_VERSIONS_DEFAULT},
+		{-1, FILE_VERSIONS_DEFAULT},
+		{1, 1},
+		{20, 20},
+	}
+
+	for _, test := range tests {
+		if got := (User{VersionsKept: test.versionsKept}).VersionsToKeep(); got != test.want {
+			t.Errorf("VersionsToKeep() with versions_kept %v = %v, want %v", test.versionsKept, got, test.want)
+		}
+	}
+}
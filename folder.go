@@ -0,0 +1,19 @@
+package main
+
+// Folder is a folder in a user's namespace. Files are placed in folders by their Folder
+// path; a folder record exists for every folder that has been created or had a file
+// recorded in it, so that empty folders can be listed too.
+type Folder struct {
+	ID        string `bson:"id" json:"id"`
+	UserName  string `bson:"user_name" json:"user_name"`
+	Path      string `bson:"path" json:"path"`             // e.g. "/photos/2023", never "/"
+	CreatedAt int64  `bson:"created_at" json:"created_at"` // in unix time
+}
+
+// FolderListing is the content of a folder: the folders and (latest versions of) files
+// directly in it, or anywhere below it for a recursive listing.
+type FolderListing struct {
+	Path    string         `json:"path"`
+	Folders []Folder       `json:"folders"`
+	Files   []UploadedFile `json:"files"`
+}
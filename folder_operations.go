@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CleanFolderPath returns the folder path in its canonical form: absolute, without a
+// trailing slash, "." or ".." elements. An empty path is the root folder "/".
+func CleanFolderPath(folder string) string {
+	return path.Clean("/" + folder)
+}
+
+// folderMatch matches the files directly in the folder. Files recorded before folders
+// existed have no folder and are in the root folder.
+func folderMatch(folder string) bson.E {
+	if folder == "/" {
+		return bson.E{Key: "folder", Value: bson.D{{Key: "$in", Value: bson.A{"/", nil}}}}
+	}
+
+	return bson.E{Key: "folder", Value: folder}
+}
+
+// subtreeRegex matches the folder and every folder below it.
+func subtreeRegex(folder string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(folder) + "(/|$)"}
+}
+
+// fileFilter matches every version of the user's file with the given folder and name,
+// except those in the trash.
+func fileFilter(username string, folder string, fileName string) bson.D {
+	return bson.D{
+		{Key: "uploader_username", Value: username},
+		folderMatch(CleanFolderPath(folder)),
+		{Key: "file_name", Value: fileName},
+		notTrashed(),
+	}
+}
+
+// EnsureFolder creates the folder, and any of its parents, if they do not exist yet.
+func EnsureFolder(username string, folder string) error {
+	now := time.Now().Unix()
+
+	for folder = CleanFolderPath(folder); folder != "/"; folder = path.Dir(folder) {
+		filter := bson.D{{Key: "user_name", Value: username}, {Key: "path", Value: folder}}
+		update := bson.D{{Key: "$setOnInsert", Value: bson.D{
+			{Key: "id", Value: primitive.NewObjectID().Hex()},
+			{Key: "created_at", Value: now},
+		}}}
+
+		if _, err := foldersColl.UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// folderExists reports whether the user has the folder. The root folder always exists.
+func folderExists(username string, folder string) (bool, error) {
+	if folder == "/" {
+		return true, nil
+	}
+
+	count, err := foldersColl.CountDocuments(context.Background(), bson.D{{Key: "user_name", Value: username}, {Key: "path", Value: folder}})
+	return count > 0, err
+}
+
+// ListFolder returns the folders and the latest versions of the files in the user's
+// folder. If recursive is set, everything below the folder is listed as well. Where the
+// files are stored is only listed for the user themselves.
+func ListFolder(username string, folder string, recursive bool, requester string) (FolderListing, error) {
+	folder = CleanFolderPath(folder)
+
+	if exists, err := folderExists(username, folder); err != nil {
+		return FolderListing{}, err
+	} else if !exists {
+		return FolderListing{}, fmt.Errorf("folder not found")
+	}
+
+	// Folders below the given one; only its children unless the listing is recursive
+	folderPattern := "^" + regexp.QuoteMeta(strings.TrimSuffix(folder, "/")) + "/[^/]+$"
+	if recursive {
+		folderPattern = "^" + regexp.QuoteMeta(strings.TrimSuffix(folder, "/")) + "/"
+	}
+	folderFilter := bson.D{
+		{Key: "user_name", Value: username},
+		{Key: "path", Value: primitive.Regex{Pattern: folderPattern}},
+	}
+
+	cursor, err := foldersColl.Find(context.Background(), folderFilter, options.Find().SetSort(bson.D{{Key: "path", Value: 1}}))
+	if err != nil {
+		return FolderListing{}, err
+	}
+	listing := FolderListing{Path: folder, Folders: []Folder{}, Files: []UploadedFile{}}
+	if err := cursor.All(context.Background(), &listing.Folders); err != nil {
+		return FolderListing{}, err
+	}
+
+	fileFilter := bson.D{
+		{Key: "uploader_username", Value: username},
+		{Key: "is_latest", Value: bson.D{{Key: "$ne", Value: false}}},
+		notTrashed(),
+	}
+	if !recursive {
+		fileFilter = append(fileFilter, folderMatch(folder))
+	} else if folder != "/" {
+		fileFilter = append(fileFilter, bson.E{Key: "folder", Value: subtreeRegex(folder)})
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "folder", Value: 1}, {Key: "file_name", Value: 1}})
+	cursor, err = uploadedFilesColl.Find(context.Background(), fileFilter, opts)
+	if err != nil {
+		return FolderListing{}, err
+	}
+	if err := cursor.All(context.Background(), &listing.Files); err != nil {
+		return FolderListing{}, err
+	}
+
+	if requester != username {
+		for i, file := range listing.Files {
+			listing.Files[i] = file.WithoutStorageDetails()
+		}
+	}
+
+	return listing, nil
+}
+
+// MoveFile moves (and/or renames) every version of the user's file.
+func MoveFile(username string, folder string, fileName string, newFolder string, newName string) error {
+	newFolder = CleanFolderPath(newFolder)
+	if newName == "" || strings.Contains(newName, "/") {
+		return fmt.Errorf("invalid file name")
+	}
+
+	// Versions in the trash count too, since the moved versions would clash with their numbers
+	existing := bson.D{{Key: "uploader_username", Value: username}, folderMatch(newFolder), {Key: "file_name", Value: newName}}
+	if count, err := uploadedFilesColl.CountDocuments(context.Background(), existing); err != nil {
+		return err
+	} else if count > 0 {
+		return fmt.Errorf("a file named %v already exists in %v or the trash", newName, newFolder)
+	}
+
+	if err := EnsureFolder(username, newFolder); err != nil {
+		return err
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "folder", Value: newFolder},
+		{Key: "file_name", Value: newName},
+	}}}
+	if result, err := uploadedFilesColl.UpdateMany(context.Background(), fileFilter(username, folder, fileName), update); err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return fmt.Errorf("file not found")
+	}
+
+	return moveShareGrants(username, folder, fileName, newFolder, newName)
+}
+
+// MoveFolder moves (and/or renames) the user's folder along with everything below it.
+func MoveFolder(username string, from string, to string) error {
+	from = CleanFolderPath(from)
+	to = CleanFolderPath(to)
+
+	if from == "/" || to == "/" {
+		return fmt.Errorf("the root folder cannot be moved or replaced")
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return fmt.Errorf("a folder cannot be moved into itself")
+	}
+
+	if exists, err := folderExists(username, from); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("folder not found")
+	}
+	if exists, err := folderExists(username, to); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("folder %v already exists", to)
+	}
+
+	trashed := bson.D{{Key: "uploader_username", Value: username}, {Key: "folder", Value: subtreeRegex(to)}}
+	if count, err := uploadedFilesColl.CountDocuments(context.Background(), trashed); err != nil {
+		return err
+	} else if count > 0 {
+		return fmt.Errorf("files from %v are still in the trash", to)
+	}
+
+	if err := EnsureFolder(username, path.Dir(to)); err != nil {
+		return err
+	}
+
+	// Replace the from prefix of every path in the subtree with to
+	rewrite := func(field string) mongo.Pipeline {
+		return mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: field, Value: bson.D{{Key: "$concat", Value: bson.A{
+			to,
+			bson.D{{Key: "$substrCP", Value: bson.A{"$" + field, utf8.RuneCountInString(from), bson.D{{Key: "$strLenCP", Value: "$" + field}}}}},
+		}}}}}}}}
+	}
+
+	folderFilter := bson.D{{Key: "user_name", Value: username}, {Key: "path", Value: subtreeRegex(from)}}
+	if _, err := foldersColl.UpdateMany(context.Background(), folderFilter, rewrite("path")); err != nil {
+		return err
+	}
+
+	fileFilter := bson.D{{Key: "uploader_username", Value: username}, {Key: "folder", Value: subtreeRegex(from)}}
+	if _, err := uploadedFilesColl.UpdateMany(context.Background(), fileFilter, rewrite("folder")); err != nil {
+		return err
+	}
+
+	grantFilter := bson.D{{Key: "owner", Value: username}, {Key: "folder", Value: subtreeRegex(from)}}
+	if _, err := shareGrantsColl.UpdateMany(context.Background(), grantFilter, rewrite("folder")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteFolder deletes the user's folder along with every folder below it, and moves every
+// version of every file below it to the trash. If permanent is set, the files are deleted
+// straight away instead, reversing their capacity accounting. It returns the number of
+// file records trashed or deleted.
+func DeleteFolder(username string, folder string, permanent bool) (int, error) {
+	folder = CleanFolderPath(folder)
+	if folder == "/" {
+		return 0, fmt.Errorf("the root folder cannot be deleted")
+	}
+
+	if exists, err := folderExists(username, folder); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, fmt.Errorf("folder not found")
+	}
+
+	folderFilter := bson.D{{Key: "user_name", Value: username}, {Key: "path", Value: subtreeRegex(folder)}}
+	fileFilter := bson.D{{Key: "uploader_username", Value: username}, {Key: "folder", Value: subtreeRegex(folder)}}
+
+	if !permanent {
+		trash := bson.D{{Key: "$set", Value: bson.D{{Key: "trashed_at", Value: time.Now().Unix()}}}}
+		result, err := uploadedFilesColl.UpdateMany(context.Background(), append(fileFilter, notTrashed()), trash)
+		if err != nil {
+			return 0, err
+		}
+
+		// Restoring a file recreates its folder
+		if _, err := foldersColl.DeleteMany(context.Background(), folderFilter); err != nil {
+			return int(result.ModifiedCount), err
+		}
+
+		return int(result.ModifiedCount), nil
+	}
+
+	// References first, so that removing them never has to promote one of them
+	opts := options.Find().SetSort(bson.D{{Key: "is_reference", Value: -1}, {Key: "_id", Value: 1}})
+	cursor, err := uploadedFilesColl.Find(context.Background(), fileFilter, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, file := range files {
+		file, found, err := reloadUploadedFile(file)
+		if err != nil {
+			return deleted, err
+		} else if !found {
+			continue
+		}
+
+		if err := RemoveUploadedFile(file); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	if _, err := foldersColl.DeleteMany(context.Background(), folderFilter); err != nil {
+		return deleted, err
+	}
+
+	grantFilter := bson.D{{Key: "owner", Value: username}, {Key: "folder", Value: subtreeRegex(folder)}}
+	if _, err := shareGrantsColl.DeleteMany(context.Background(), grantFilter); err != nil {
+		return deleted, err
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCleanFolderPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"photos", "/photos"},
+		{"/photos/", "/photos"},
+		{"//photos//2024", "/photos/2024"},
+		{"/photos/./2024", "/photos/2024"},
+		{"/photos/../docs", "/docs"},
+		{"../../etc", "/etc"},
+	}
+
+	for _, test := range tests {
+		if got := CleanFolderPath(test.in); got != test.want {
+			t.Errorf("CleanFolderPath(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSubtreeRegex(t *testing.T) {
+	tests := []struct {
+		folder string
+		path   string
+		want   bool
+	}{
+		{"/photos", "/photos", true},
+		{"/photos", "/photos/2024", true},
+		{"/photos", "/photos/2024/june", true},
+		{"/photos", "/photoshop", false},
+		{"/photos", "/docs/photos", false},
+		{"/photos", "/", false},
+		{"/a.b", "/a.b/c", true},
+		{"/a.b", "/axb", false},
+		{"/a+b", "/a+b", true},
+	}
+
+	for _, test := range tests {
+		pattern := regexp.MustCompile(subtreeRegex(test.folder).Pattern)
+		if got := pattern.MatchString(test.path); got != test.want {
+			t.Errorf("subtreeRegex(%q) matches %q = %v, want %v", test.folder, test.path, got, test.want)
+		}
+	}
+}
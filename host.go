@@ -0,0 +1,45 @@
+package main
+
+// Host is a node that contributes storage to the storage pool. Nodes keep their entry
+// alive by sending heartbeats; the Status is derived from the time of the last one.
+type Host struct {
+	UserName       string  `bson:"user_name" json:"user_name"`
+	Address        string  `bson:"address" json:"address"`
+	RelayAddress   string  `bson:"relay_address" json:"relay_address"`
+	Timezone       string  `bson:"timezone" json:"timezone"`
+	FreeSpace      float64 `bson:"free_space" json:"free_space"`           // in gigabytes
+	FirstSeen      int64   `bson:"first_seen" json:"first_seen"`           // in unix time
+	LastHeartbeat  int64   `bson:"last_heartbeat" json:"last_heartbeat"`   // in unix time
+	HeartbeatCount int64   `bson:"heartbeat_count" json:"heartbeat_count"` // since first seen
+
+	// HourlyHeartbeats counts the heartbeats received in each hour of the day (UTC),
+	// keyed by the hour ("0" to "23"). It is used to estimate when the host is online.
+	HourlyHeartbeats map[string]int64 `bson:"hourly_heartbeats" json:"hourly_heartbeats"`
+
+	ChallengesPassed int64 `bson:"challenges_passed" json:"challenges_passed"`
+	ChallengesFailed int64 `bson:"challenges_failed" json:"challenges_failed"`
+	RepairsAssigned  int64 `bson:"repairs_assigned" json:"repairs_assigned"`
+	RepairsCompleted int64 `bson:"repairs_completed" json:"repairs_completed"`
+	CorruptShards    int64 `bson:"corrupt_shards" json:"corrupt_shards"` // shards reported corrupt by downloaders
+
+	Reputation float64 `bson:"reputation" json:"reputation"` // 0-1, see ComputeReputation
+
+	// The addresses the node can currently be reached at, for rendezvous
+	Endpoints          []string `bson:"endpoints" json:"endpoints"`
+	EndpointsUpdatedAt int64    `bson:"endpoints_updated_at" json:"endpoints_updated_at"` // in unix time
+
+	Status string `bson:"-" json:"status"`
+}
+
+// hostStatus returns the liveness status of a host whose last heartbeat was at lastHeartbeat.
+func hostStatus(lastHeartbeat int64, now int64) string {
+	age := now - lastHeartbeat
+
+	if age <= int64(HOST_STALE_AFTER.Seconds()) {
+		return HOST_ONLINE
+	} else if age <= int64(HOST_DEAD_AFTER.Seconds()) {
+		return HOST_STALE
+	} else {
+		return HOST_DEAD
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// HourlyAvailability estimates, for each hour of the day (UTC), the probability that the
+// host is online, from the heartbeats it sent during that hour since it was first seen.
+// Hosts seen for less than a day get HOST_DEFAULT_AVAILABILITY for every hour.
+func (h Host) HourlyAvailability(now int64) [24]float64 {
+	var availability [24]float64
+
+	observed := now - h.FirstSeen
+	if h.FirstSeen == 0 || observed < 24*60*60 {
+		for hour := range availability {
+			availability[hour] = HOST_DEFAULT_AVAILABILITY
+		}
+		return availability
+	}
+
+	days := float64(observed) / (24 * 60 * 60)
+	expected := days * float64(time.Hour/HOST_HEARTBEAT_INTERVAL)
+
+	for hour := range availability {
+		availability[hour] = math.Min(1, float64(h.HourlyHeartbeats[strconv.Itoa(hour)])/expected)
+	}
+
+	return availability
+}
+
+// FileAvailability is the estimated probability that enough shards of a file are online to
+// reassemble it, for each hour of the day (UTC) and averaged over the day.
+type FileAvailability struct {
+	Score  float64     `json:"score"`
+	Hourly [24]float64 `json:"hourly"`
+}
+
+// GetFileAvailability estimates the availability of a file whose shards are held by the
+// given hosts, any dataShards of which are needed to reassemble it. Hosts that are not in
+// the host registry are assumed to be always offline.
+func GetFileAvailability(placement [][]string, dataShards int) (FileAvailability, error) {
+	addresses := bson.A{}
+	for _, shardHosts := range placement {
+		for _, address := range shardHosts {
+			addresses = append(addresses, address)
+		}
+	}
+
+	cursor, err := hostsColl.Find(context.Background(), bson.D{{Key: "address", Value: bson.D{{Key: "$in", Value: addresses}}}})
+	if err != nil {
+		return FileAvailability{}, err
+	}
+
+	var hosts []Host
+	if err := cursor.All(context.Background(), &hosts); err != nil {
+		return FileAvailability{}, err
+	}
+
+	now := time.Now().Unix()
+	hostAvailability := make(map[string][24]float64)
+	for _, host := range hosts {
+		hostAvailability[host.Address] = host.HourlyAvailability(now)
+	}
+
+	return fileAvailability(placement, dataShards, hostAvailability), nil
+}
+
+// fileAvailability computes the file availability from each host's hourly availability.
+// A shard is online if any of its hosts is, and the file is available if at least
+// dataShards shards are online. Hosts are assumed to go offline independently.
+func fileAvailability(placement [][]string, dataShards int, hostAvailability map[string][24]float64) FileAvailability {
+	if dataShards <= 0 {
+		dataShards = 1
+	}
+
+	var result FileAvailability
+	for hour := 0; hour < 24; hour++ {
+		shardOnline := make([]float64, len(placement))
+		for shard, shardHosts := range placement {
+			allOffline := 1.0
+			for _, address := range shardHosts {
+				allOffline *= 1 - hostAvailability[address][hour]
+			}
+			shardOnline[shard] = 1 - allOffline
+		}
+
+		result.Hourly[hour] = atLeastProbability(shardOnline, dataShards)
+		result.Score += result.Hourly[hour] / 24
+	}
+
+	return result
+}
+
+// atLeastProbability returns the probability that at least k of the independent events
+// with the given probabilities happen.
+func atLeastProbability(probabilities []float64, k int) float64 {
+	// exactly[j] is the probability that exactly j of the events seen so far happened
+	exactly := make([]float64, len(probabilities)+1)
+	exactly[0] = 1
+
+	for i, p := range probabilities {
+		for j := i + 1; j > 0; j-- {
+			exactly[j] = exactly[j]*(1-p) + exactly[j-1]*p
+		}
+		exactly[0] *= 1 - p
+	}
+
+	total := 0.0
+	for j := k; j < len(exactly); j++ {
+		total += exactly[j]
+	}
+
+	return total
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RecordHeartbeat marks the user's node as online and records the free space it
+// contributes. The host is registered on its first heartbeat. Uptime is measured in
+// heartbeats, so one is only counted if HOST_HEARTBEAT_COUNT_GAP has passed since the last.
+// Shards, challenges and credits follow the address, so an address already held by another
+// user's host is refused.
+func RecordHeartbeat(username string, address string, relayAddress string, freeSpace float64) (Host, error) {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return Host{}, err
+	}
+
+	if address == "" {
+		address = user.Address
+	}
+	if relayAddress == "" {
+		relayAddress = user.RelayAddress
+	}
+
+	taken := bson.D{{Key: "address", Value: address}, {Key: "user_name", Value: bson.D{{Key: "$ne", Value: username}}}}
+	if count, err := hostsColl.CountDocuments(context.Background(), taken); err != nil {
+		return Host{}, err
+	} else if count > 0 {
+		return Host{}, fmt.Errorf("address %v is registered to another host", address)
+	}
+
+	now := time.Now().Unix()
+	hourField := "hourly_heartbeats." + strconv.Itoa(time.Unix(now, 0).UTC().Hour())
+
+	// Moving last_heartbeat along with the count keeps concurrent heartbeats from both counting
+	due := bson.D{
+		{Key: "user_name", Value: username},
+		{Key: "last_heartbeat", Value: bson.D{{Key: "$lte", Value: now - int64(HOST_HEARTBEAT_COUNT_GAP.Seconds())}}},
+	}
+	count := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "last_heartbeat", Value: now}}},
+		{Key: "$inc", Value: bson.D{
+			{Key: "heartbeat_count", Value: 1},
+			{Key: hourField, Value: 1},
+		}},
+	}
+	if _, err := hostsColl.UpdateOne(context.Background(), due, count); err != nil {
+		return Host{}, err
+	}
+
+	filter := bson.D{{Key: "user_name", Value: username}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "address", Value: address},
+			{Key: "relay_address", Value: relayAddress},
+			{Key: "timezone", Value: user.Timezone},
+			{Key: "free_space", Value: freeSpace},
+			{Key: "last_heartbeat", Value: now},
+		}},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "first_seen", Value: now},
+			{Key: "reputation", Value: REPUTATION_DEFAULT},
+			{Key: "heartbeat_count", Value: 1},
+			{Key: hourField, Value: 1},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var host Host
+	if err := hostsColl.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&host); err != nil {
+		// Another host took the address since it was checked
+		if mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), HOST_ADDRESS_INDEX_NAME) {
+			return Host{}, fmt.Errorf("address %v is registered to another host", address)
+		}
+		return Host{}, err
+	}
+	host.Status = hostStatus(host.LastHeartbeat, now)
+
+	return host, nil
+}
+
+// GetHosts returns the registered hosts with one of the given statuses, or every host
+// if no status is given.
+func GetHosts(statuses ...string) ([]Host, error) {
+	now := time.Now().Unix()
+
+	var conditions bson.A
+	for _, status := range statuses {
+		condition, err := hostStatusFilter(status, now)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	filter := bson.D{}
+	if len(conditions) > 0 {
+		filter = bson.D{{Key: "$or", Value: conditions}}
+	}
+
+	cursor, err := hostsColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "last_heartbeat", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []Host{}
+	if err := cursor.All(context.Background(), &hosts); err != nil {
+		return nil, err
+	}
+
+	for i := range hosts {
+		hosts[i].Status = hostStatus(hosts[i].LastHeartbeat, now)
+	}
+
+	return hosts, nil
+}
+
+// GetHostByAddress returns the host registered with the given address.
+func GetHostByAddress(address string) (Host, error) {
+	var host Host
+	if err := hostsColl.FindOne(context.Background(), bson.D{{Key: "address", Value: address}}).Decode(&host); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Host{}, fmt.Errorf("host not found")
+		}
+		return Host{}, err
+	}
+	host.Status = hostStatus(host.LastHeartbeat, time.Now().Unix())
+
+	return host, nil
+}
+
+// DeleteHost removes the user's node from the host registry.
+func DeleteHost(username string) error {
+	if _, err := hostsColl.DeleteOne(context.Background(), bson.D{{Key: "user_name", Value: username}}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hostStatusFilter returns the query matching hosts with the given status.
+func hostStatusFilter(status string, now int64) (bson.D, error) {
+	staleSince := now - int64(HOST_STALE_AFTER.Seconds())
+	deadSince := now - int64(HOST_DEAD_AFTER.Seconds())
+
+	switch status {
+	case HOST_ONLINE:
+		return bson.D{{Key: "last_heartbeat", Value: bson.D{{Key: "$gte", Value: staleSince}}}}, nil
+	case HOST_STALE:
+		return bson.D{{Key: "last_heartbeat", Value: bson.D{{Key: "$lt", Value: staleSince}, {Key: "$gte", Value: deadSince}}}}, nil
+	case HOST_DEAD:
+		return bson.D{{Key: "last_heartbeat", Value: bson.D{{Key: "$lt", Value: deadSince}}}}, nil
+	default:
+		return nil, fmt.Errorf("invalid host status [%v]", status)
+	}
+}
+
+// incrementHostCounter adds one to a counter of the host with the given address, logging
+// any error since the counters only feed the host's reputation.
+func incrementHostCounter(address string, counter string) {
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: counter, Value: 1}}}}
+
+	if _, err := hostsColl.UpdateOne(context.Background(), bson.D{{Key: "address", Value: address}}, update); err != nil {
+		log.Printf("Unable to increment %v of host %v: %v\n", counter, address, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Reputation is a host's reliability score between 0 and 1, and the components it is the
+// weighted sum of.
+type Reputation struct {
+	UserName      string  `json:"user_name"`
+	Score         float64 `json:"score"`
+	Uptime        float64 `json:"uptime"`         // share of expected heartbeats received
+	ChallengeRate float64 `json:"challenge_rate"` // share of storage challenges passed
+	RepairRate    float64 `json:"repair_rate"`    // share of assigned repairs completed
+	AccountAge    float64 `json:"account_age"`    // account age relative to REPUTATION_MATURITY
+}
+
+// ComputeReputation scores the host. The challenge and repair rates start out at 0.5 and
+// move towards the observed rate as challenges and repairs accumulate, so that a single
+// early failure does not ruin a new host.
+func ComputeReputation(host Host, user User, now int64) Reputation {
+	reputation := Reputation{UserName: host.UserName}
+
+	if host.FirstSeen == 0 || now-host.FirstSeen < int64(HOST_HEARTBEAT_INTERVAL.Seconds()) {
+		reputation.Uptime = HOST_DEFAULT_AVAILABILITY
+	} else {
+		expected := float64(now-host.FirstSeen) / HOST_HEARTBEAT_INTERVAL.Seconds()
+		reputation.Uptime = math.Min(1, float64(host.HeartbeatCount)/expected)
+	}
+
+	reputation.ChallengeRate = float64(host.ChallengesPassed+1) / float64(host.ChallengesPassed+host.ChallengesFailed+2)
+	reputation.RepairRate = float64(host.RepairsCompleted+1) / float64(host.RepairsAssigned+2)
+
+	// Users registered before creation dates were recorded are aged from their first heartbeat
+	since := user.CreatedAt
+	if since == 0 {
+		since = host.FirstSeen
+	}
+	if since > 0 && now > since {
+		reputation.AccountAge = math.Min(1, float64(now-since)/REPUTATION_MATURITY.Seconds())
+	}
+
+	reputation.Score = REPUTATION_UPTIME_WEIGHT*reputation.Uptime +
+		REPUTATION_CHALLENGE_WEIGHT*reputation.ChallengeRate +
+		REPUTATION_REPAIR_WEIGHT*reputation.RepairRate +
+		REPUTATION_AGE_WEIGHT*reputation.AccountAge
+
+	return reputation
+}
+
+// GetReputation computes the current reputation of the user's host.
+func GetReputation(username string) (Reputation, error) {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return Reputation{}, err
+	}
+
+	var host Host
+	if err := hostsColl.FindOne(context.Background(), bson.D{{Key: "user_name", Value: username}}).Decode(&host); err != nil {
+		return Reputation{}, err
+	}
+
+	return ComputeReputation(host, user, time.Now().Unix()), nil
+}
+
+// UpdateReputations recomputes the reputation of every registered host and stores it on
+// both the host and its user.
+func UpdateReputations() error {
+	hosts, err := GetHosts()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, host := range hosts {
+		user, err := GetUserByUsername(host.UserName)
+		if err != nil {
+			continue
+		}
+
+		reputation := ComputeReputation(host, user, now)
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "reputation", Value: reputation.Score}}}}
+		filter := bson.D{{Key: "user_name", Value: host.UserName}}
+
+		if _, err := hostsColl.UpdateOne(context.Background(), filter, update); err != nil {
+			return err
+		}
+		if _, err := userDetailsColl.UpdateOne(context.Background(), filter, update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunReputationUpdater recomputes the host reputations every interval. It blocks and is
+// meant to be run in its own goroutine.
+func RunReputationUpdater(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := UpdateReputations(); err != nil {
+			log.Println("Unable to update host reputations:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// reputationWeight scales a placement score by the host's reputation, so that a host with
+// no reputation still has REPUTATION_SELECTION_FLOOR of the weight of a perfect one.
+func reputationWeight(reputation float64) float64 {
+	return REPUTATION_SELECTION_FLOOR + (1-REPUTATION_SELECTION_FLOOR)*reputation
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestComputeReputation(t *testing.T) {
+	const now = int64(1_000_000_000)
+	interval := int64(HOST_HEARTBEAT_INTERVAL.Seconds())
+	maturity := int64(REPUTATION_MATURITY.Seconds())
+
+	tests := []struct {
+		name string
+		host Host
+		user User
+		want Reputation
+	}{
+		{
+			name: "new host",
+			host: Host{UserName: "a", FirstSeen: now},
+			user: User{CreatedAt: now},
+			want: Reputation{Uptime: HOST_DEFAULT_AVAILABILITY, ChallengeRate: 0.5, RepairRate: 0.5},
+		},
+		{
+			name: "half the expected heartbeats",
+			host: Host{UserName: "a", FirstSeen: now - 100*interval, HeartbeatCount: 50},
+			user: User{CreatedAt: now - maturity/2},
+			want: Reputation{Uptime: 0.5, ChallengeRate: 0.5, RepairRate: 0.5, AccountAge: 0.5},
+		},
+		{
+			name: "uptime and age are capped",
+			host: Host{UserName: "a", FirstSeen: now - 10*interval, HeartbeatCount: 50},
+			user: User{CreatedAt: now - 2*maturity},
+			want: Reputation{Uptime: 1, ChallengeRate: 0.5, RepairRate: 0.5, AccountAge: 1},
+		},
+		{
+			name: "challenge and repair rates move towards the observed rate",
+			host: Host{UserName: "a", FirstSeen: now - 10*interval, HeartbeatCount: 10, ChallengesPassed: 8, RepairsAssigned: 3, RepairsCompleted: 0},
+			user: User{CreatedAt: now},
+			want: Reputation{Uptime: 1, ChallengeRate: 0.9, RepairRate: 0.2},
+		},
+		{
+			name: "age from the first heartbeat without a creation date",
+			host: Host{UserName: "a", FirstSeen: now - maturity/4, HeartbeatCount: 0},
+			user: User{},
+			want: Reputation{Uptime: 0, ChallengeRate: 0.5, RepairRate: 0.5, AccountAge: 0.25},
+		},
+	}
+
+	for _, test := range tests {
+		got := ComputeReputation(test.host, test.user, now)
+
+		want := test.want
+		want.UserName = test.host.UserName
+		want.Score = REPUTATION_UPTIME_WEIGHT*want.Uptime +
+			REPUTATION_CHALLENGE_WEIGHT*want.ChallengeRate +
+			REPUTATION_REPAIR_WEIGHT*want.RepairRate +
+			REPUTATION_AGE_WEIGHT*want.AccountAge
+
+		if got.UserName != want.UserName || !near(got.Uptime, want.Uptime) || !near(got.ChallengeRate, want.ChallengeRate) ||
+			!near(got.RepairRate, want.RepairRate) || !near(got.AccountAge, want.AccountAge) || !near(got.Score, want.Score) {
+			t.Errorf("%v: ComputeReputation() = %+v, want %+v", test.name, got, want)
+		}
+	}
+}
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
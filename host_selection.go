@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SelectShardHosts picks replicas distinct online hosts for each of numShards shards of
+// shardSize gigabytes. Every host has room for its shard and no host is given two shards,
+// so losing a single host never loses more than one shard of the file. The uploader's own
+// node is never selected.
+//
+// Hosts are picked one at a time, preferring those that are usually online during the
+// hours of the day the hosts already picked are not, and those in timezones the file
+// does not use yet, so that enough shards are likely to be online at any hour. Scores
+// are weighted by the hosts' reputation.
+//
+// The space for the shards is reserved on the picked hosts until their next heartbeat
+// reports the real figure, so that concurrent uploads do not overcommit them.
+func SelectShardHosts(numShards int, replicas int, shardSize float64, uploaderUsername string) ([][]string, error) {
+	if numShards <= 0 || replicas <= 0 {
+		return nil, fmt.Errorf("shards and replicas must be positive")
+	}
+
+	for attempt := 1; ; attempt++ {
+		placement, err := pickShardHosts(numShards, replicas, shardSize, uploaderUsername)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := reserveHostSpace(placement, shardSize); err == nil {
+			return placement, nil
+		} else if attempt == PLACEMENT_RESERVE_ATTEMPTS {
+			return nil, err
+		}
+	}
+}
+
+// pickShardHosts picks the hosts for SelectShardHosts without reserving their space.
+func pickShardHosts(numShards int, replicas int, shardSize float64, uploaderUsername string) ([][]string, error) {
+	candidates, err := getPlacementCandidates(shardSize, uploaderUsername)
+	if err != nil {
+		return nil, err
+	}
+
+	needed := numShards * replicas
+	if len(candidates) < needed {
+		return nil, fmt.Errorf("only %v online hosts have %.2f GB free, %v needed", len(candidates), shardSize, needed)
+	}
+
+	now := time.Now().Unix()
+	availability := make([][24]float64, len(candidates))
+	for i, host := range candidates {
+		availability[i] = host.HourlyAvailability(now)
+	}
+
+	placement := make([][]string, numShards)
+	picked := make([]bool, len(candidates))
+	timezoneUses := make(map[string]int)
+	var coverage [24]float64 // expected number of picked hosts online in each hour
+
+	for replica := 0; replica < replicas; replica++ {
+		for shard := 0; shard < numShards; shard++ {
+			best := -1
+			bestScore := 0.0
+
+			for i, host := range candidates {
+				if picked[i] {
+					continue
+				}
+
+				score := 0.0
+				for hour := range coverage {
+					score += availability[i][hour] / (1 + coverage[hour]) / 24
+				}
+				score += PLACEMENT_TIMEZONE_WEIGHT / float64(1+timezoneUses[host.Timezone])
+				score *= reputationWeight(host.Reputation)
+
+				// Candidates are sorted by free space, so ties go to the roomiest host
+				if best == -1 || score > bestScore {
+					best = i
+					bestScore = score
+				}
+			}
+
+			picked[best] = true
+			timezoneUses[candidates[best].Timezone]++
+			for hour := range coverage {
+				coverage[hour] += availability[best][hour]
+			}
+			placement[shard] = append(placement[shard], candidates[best].Address)
+		}
+	}
+
+	return placement, nil
+}
+
+// reserveHostSpace takes shardSize gigabytes off the free space of every host in the
+// placement. If a host no longer has the room, the space already reserved is given back.
+func reserveHostSpace(placement [][]string, shardSize float64) error {
+	var reserved []string
+	release := func() {
+		releaseHostSpace([][]string{reserved}, shardSize)
+	}
+
+	for _, shardHosts := range placement {
+		for _, address := range shardHosts {
+			filter := bson.D{{Key: "address", Value: address}, {Key: "free_space", Value: bson.D{{Key: "$gte", Value: shardSize}}}}
+			update := bson.D{{Key: "$inc", Value: bson.D{{Key: "free_space", Value: -shardSize}}}}
+
+			result, err := hostsColl.UpdateOne(context.Background(), filter, update)
+			if err != nil {
+				release()
+				return err
+			}
+			if result.ModifiedCount == 0 {
+				release()
+				return fmt.Errorf("host %v no longer has %.2f GB free", address, shardSize)
+			}
+			reserved = append(reserved, address)
+		}
+	}
+
+	return nil
+}
+
+// releaseHostSpace gives back the space reserved on the placement's hosts for shards that
+// will not be stored after all. A host's next heartbeat reports its free space afresh, so
+// this only matters until then.
+func releaseHostSpace(placement [][]string, shardSize float64) {
+	for _, shardHosts := range placement {
+		for _, address := range shardHosts {
+			update := bson.D{{Key: "$inc", Value: bson.D{{Key: "free_space", Value: shardSize}}}}
+			if _, err := hostsColl.UpdateOne(context.Background(), bson.D{{Key: "address", Value: address}}, update); err != nil {
+				log.Println("Unable to release reserved host space:", err)
+			}
+		}
+	}
+}
+
+// getPlacementCandidates returns the online hosts, other than the uploader's, with at least
+// shardSize gigabytes free, those with the most free space first.
+func getPlacementCandidates(shardSize float64, uploaderUsername string) ([]Host, error) {
+	now := time.Now().Unix()
+	filter := bson.D{
+		{Key: "last_heartbeat", Value: bson.D{{Key: "$gte", Value: now - int64(HOST_STALE_AFTER.Seconds())}}},
+		{Key: "free_space", Value: bson.D{{Key: "$gte", Value: shardSize}}},
+		{Key: "user_name", Value: bson.D{{Key: "$ne", Value: uploaderUsername}}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "free_space", Value: -1}})
+
+	cursor, err := hostsColl.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []Host{}
+	if err := cursor.All(context.Background(), &hosts); err != nil {
+		return nil, err
+	}
+
+	for i := range hosts {
+		hosts[i].Status = HOST_ONLINE
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+// Introduction brokers a connection between two nodes. Both nodes are given each other's
+// endpoints and first try to connect directly (e.g. by hole punching). If that fails, the
+// introduction moves to the relay stage and both connect through the relay.
+type Introduction struct {
+	ID            string   `bson:"id" json:"id"`
+	From          string   `bson:"from" json:"from"` // username of the node asking for the introduction
+	To            string   `bson:"to" json:"to"`
+	FromEndpoints []string `bson:"from_endpoints" json:"from_endpoints"`
+	ToEndpoints   []string `bson:"to_endpoints" json:"to_endpoints"`
+	Relay         string   `bson:"relay" json:"relay"` // used in the relay stage
+	Stage         string   `bson:"stage" json:"stage"`
+	Status        string   `bson:"status" json:"status"`
+	CreatedAt     int64    `bson:"created_at" json:"created_at"` // in unix time
+	ExpiresAt     int64    `bson:"expires_at" json:"expires_at"` // in unix time
+}
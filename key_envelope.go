@@ -0,0 +1,15 @@
+package main
+
+// KeyEnvelope is the key of an uploaded file (one version of it) wrapped by the uploader
+// to a recipient's registered public key. The server only stores and hands out the
+// opaque wrapped key and never sees the file key itself.
+type KeyEnvelope struct {
+	ID          string `bson:"id" json:"id"`
+	FileID      string `bson:"file_id" json:"file_id"`
+	Owner       string `bson:"owner" json:"owner"` // the file's uploader
+	Recipient   string `bson:"recipient" json:"recipient"`
+	WrappedKey  string `bson:"wrapped_key" json:"wrapped_key"` // base64
+	Fingerprint string `bson:"fingerprint" json:"fingerprint"` // of the public key the file key was wrapped to
+	CreatedAt   int64  `bson:"created_at" json:"created_at"`   // in unix time
+	Stale       bool   `bson:"-" json:"stale,omitempty"`       // the recipient has replaced the key since
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// publicKeyFingerprint identifies a public key, so that envelopes wrapped to a key the
+// recipient has since replaced can be told apart.
+func publicKeyFingerprint(publicKey string) string {
+	hash := sha256.Sum256([]byte(publicKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// RegisterPublicKey sets the public key (base64) other users wrap file keys to for the
+// user and returns its fingerprint. A key that is already registered is only replaced if
+// replace is set; the envelopes wrapped to the old key are then deleted, since the user can
+// no longer open them and uploaders must wrap the file keys again.
+func RegisterPublicKey(username string, publicKey string, replace bool) (string, error) {
+	if _, err := base64.StdEncoding.DecodeString(publicKey); err != nil || publicKey == "" {
+		return "", fmt.Errorf("public key must be base64 encoded")
+	}
+	fingerprint := publicKeyFingerprint(publicKey)
+
+	filter := bson.D{{Key: "user_name", Value: username}}
+	if !replace {
+		filter = append(filter, bson.E{Key: "public_key", Value: bson.D{{Key: "$in", Value: bson.A{"", nil}}}})
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "public_key", Value: publicKey}}}}
+	if result, err := userDetailsColl.UpdateOne(context.Background(), filter, update); err != nil {
+		return "", err
+	} else if result.MatchedCount == 0 {
+		if _, err := GetUserByUsername(username); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("a public key is already registered for %v", username)
+	}
+
+	if replace {
+		stale := bson.D{{Key: "recipient", Value: username}, {Key: "fingerprint", Value: bson.D{{Key: "$ne", Value: fingerprint}}}}
+		if _, err := keyEnvelopesColl.DeleteMany(context.Background(), stale); err != nil {
+			return "", err
+		}
+	}
+
+	return fingerprint, nil
+}
+
+// PutKeyEnvelope stores the file key wrapped to the recipient's public key, replacing any
+// envelope the recipient already had for the file. The recipient must be the uploader or
+// a user the file is shared with. If the uploader pinned the fingerprint of the key they
+// wrapped to, the recipient's registered key must still be that one.
+func PutKeyEnvelope(file UploadedFile, recipient string, wrappedKey string, fingerprint string) (KeyEnvelope, error) {
+	if _, err := base64.StdEncoding.DecodeString(wrappedKey); err != nil || wrappedKey == "" {
+		return KeyEnvelope{}, fmt.Errorf("wrapped key must be base64 encoded")
+	}
+
+	user, err := GetUserByUsername(recipient)
+	if err != nil {
+		return KeyEnvelope{}, err
+	}
+	if user.PublicKey == "" {
+		return KeyEnvelope{}, fmt.Errorf("%v has not registered a public key", recipient)
+	}
+	if fingerprint != "" && fingerprint != publicKeyFingerprint(user.PublicKey) {
+		return KeyEnvelope{}, fmt.Errorf("the public key of %v has changed", recipient)
+	}
+
+	if canRead, err := CanReadFile(file, recipient, ""); err != nil {
+		return KeyEnvelope{}, err
+	} else if !canRead {
+		return KeyEnvelope{}, fmt.Errorf("file is not shared with %v", recipient)
+	}
+
+	envelope := KeyEnvelope{
+		ID:          primitive.NewObjectID().Hex(),
+		FileID:      file.ID.Hex(),
+		Owner:       file.UploaderUsername,
+		Recipient:   recipient,
+		WrappedKey:  wrappedKey,
+		Fingerprint: publicKeyFingerprint(user.PublicKey),
+		CreatedAt:   time.Now().Unix(),
+	}
+
+	filter := bson.D{{Key: "file_id", Value: envelope.FileID}, {Key: "recipient", Value: recipient}}
+	if _, err := keyEnvelopesColl.ReplaceOne(context.Background(), filter, envelope, options.Replace().SetUpsert(true)); err != nil {
+		return KeyEnvelope{}, err
+	}
+
+	return envelope, nil
+}
+
+// GetKeyEnvelopes returns the envelopes stored for the file, flagging those wrapped to a
+// key their recipient no longer has.
+func GetKeyEnvelopes(fileID string) ([]KeyEnvelope, error) {
+	cursor, err := keyEnvelopesColl.Find(context.Background(), bson.D{{Key: "file_id", Value: fileID}})
+	if err != nil {
+		return nil, err
+	}
+
+	envelopes := []KeyEnvelope{}
+	if err := cursor.All(context.Background(), &envelopes); err != nil {
+		return nil, err
+	}
+
+	fingerprints := map[string]string{}
+	for i, envelope := range envelopes {
+		fingerprint, ok := fingerprints[envelope.Recipient]
+		if !ok {
+			fingerprint = recipientFingerprint(envelope.Recipient)
+			fingerprints[envelope.Recipient] = fingerprint
+		}
+		envelopes[i].Stale = envelope.Fingerprint != fingerprint
+	}
+
+	return envelopes, nil
+}
+
+// recipientFingerprint returns the fingerprint of the user's registered public key, or
+// an empty string if they have none (or no longer exist).
+func recipientFingerprint(username string) string {
+	user, err := GetUserByUsername(username)
+	if err != nil || user.PublicKey == "" {
+		return ""
+	}
+
+	return publicKeyFingerprint(user.PublicKey)
+}
+
+// getKeyEnvelope returns the recipient's envelope for the file, or nil if there is none
+// wrapped to their current public key.
+func getKeyEnvelope(fileID string, recipient string) (*KeyEnvelope, error) {
+	filter := bson.D{{Key: "file_id", Value: fileID}, {Key: "recipient", Value: recipient}}
+
+	var envelope KeyEnvelope
+	if err := keyEnvelopesColl.FindOne(context.Background(), filter).Decode(&envelope); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if envelope.Fingerprint != recipientFingerprint(recipient) {
+		return nil, nil
+	}
+
+	return &envelope, nil
+}
+
+// DeleteKeyEnvelope deletes the owner's envelope with the given ID.
+func DeleteKeyEnvelope(owner string, id string) (bool, error) {
+	result, err := keyEnvelopesColl.DeleteOne(context.Background(), bson.D{{Key: "id", Value: id}, {Key: "owner", Value: owner}})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// revokeKeyEnvelopes deletes the recipient's envelopes for every version of the owner's
+// file, once the file is no longer shared with them.
+func revokeKeyEnvelopes(owner string, folder string, fileName string, recipient string) error {
+	versions, err := GetFileVersions(owner, folder, fileName)
+	if err != nil {
+		return err
+	}
+
+	fileIDs := bson.A{}
+	for _, version := range versions {
+		fileIDs = append(fileIDs, version.ID.Hex())
+	}
+
+	filter := bson.D{
+		{Key: "file_id", Value: bson.D{{Key: "$in", Value: fileIDs}}},
+		{Key: "recipient", Value: recipient},
+	}
+	_, err = keyEnvelopesColl.DeleteMany(context.Background(), filter)
+	return err
+}
+
+// deleteKeyEnvelopes deletes every envelope of a file record that has been deleted.
+func deleteKeyEnvelopes(fileID string) error {
+	_, err := keyEnvelopesColl.DeleteMany(context.Background(), bson.D{{Key: "file_id", Value: fileID}})
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalObjectStore stores objects as files in a directory, for testing without S3. Its
+// pre-signed URLs point at this server's /objects/ route, which checks their signature
+// and expiry before reading or writing the file.
+type LocalObjectStore struct {
+	Dir     string
+	BaseURL string // the URL this server is reachable at, e.g. "http://localhost:12345"
+
+	secret []byte // signs the URLs, new every time the server starts
+}
+
+// NewLocalObjectStore returns a store keeping its objects in dir.
+func NewLocalObjectStore(dir string, baseURL string) (*LocalObjectStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no object directory given")
+	}
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://localhost:%v", PORT)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &LocalObjectStore{Dir: dir, BaseURL: strings.TrimSuffix(baseURL, "/"), secret: secret}, nil
+}
+
+func (s *LocalObjectStore) PresignPut(key string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodPut, key, expiry)
+}
+
+func (s *LocalObjectStore) PresignGet(key string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, expiry)
+}
+
+func (s *LocalObjectStore) Delete(key string) error {
+	objectPath, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(objectPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *LocalObjectStore) presign(method string, key string, expiry time.Duration) (string, error) {
+	if _, err := s.objectPath(key); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	query := url.Values{
+		"method":    {method},
+		"expires":   {expires},
+		"signature": {s.sign(method, key, expires)},
+	}
+
+	return s.BaseURL + "/objects/" + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+func (s *LocalObjectStore) sign(method string, key string, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(method + "\n" + key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// objectPath returns the file the object is kept in, refusing keys that would lead
+// outside the store's directory.
+func (s *LocalObjectStore) objectPath(key string) (string, error) {
+	if key == "" || path.Clean("/"+key) != "/"+key {
+		return "", fmt.Errorf("invalid object key [%v]", key)
+	}
+
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// ServeHTTP handles the requests made to the store's pre-signed URLs.
+func (s *LocalObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/objects/")
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || query.Get("method") != r.Method {
+		http.Error(w, "invalid object URL", http.StatusForbidden)
+		return
+	}
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(s.sign(r.Method, key, query.Get("expires")))) {
+		http.Error(w, "invalid object URL signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "object URL has expired", http.StatusForbidden)
+		return
+	}
+
+	objectPath, err := s.objectPath(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		http.ServeFile(w, r, objectPath)
+
+	case http.MethodPut:
+		if err := os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		file, err := os.Create(objectPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(file, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// objectsHandler serves the pre-signed URLs of the local object store.
+func objectsHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := objectStore.(*LocalObjectStore)
+	if !ok {
+		http.Error(w, "local object store is not enabled", http.StatusNotFound)
+		return
+	}
+
+	store.ServeHTTP(w, r)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Shards are split into fixed size chunks, which are the leaves of the shard's Merkle tree.
+// Leaves are hashed as sha256(0x00 || chunk) and inner nodes as sha256(0x01 || left || right).
+// When a level has an odd number of nodes, the last node is carried up to the next level
+// unchanged.
+
+// merkleLeafHash returns the hash of a Merkle tree leaf.
+func merkleLeafHash(chunk []byte) []byte {
+	sum := sha256.Sum256(append([]byte{0x00}, chunk...))
+	return sum[:]
+}
+
+// merkleNodeHash returns the hash of an inner Merkle tree node.
+func merkleNodeHash(left []byte, right []byte) []byte {
+	data := append([]byte{0x01}, left...)
+	sum := sha256.Sum256(append(data, right...))
+	return sum[:]
+}
+
+// normaliseMerkleRoots checks that every root is a hex SHA-256 hash and every shard has at
+// least one chunk, and returns the roots in lowercase.
+func normaliseMerkleRoots(roots []string, leafCounts []int) ([]string, error) {
+	if len(roots) != len(leafCounts) {
+		return nil, fmt.Errorf("a Merkle root and chunk count is needed for every shard")
+	}
+
+	normalised := make([]string, len(roots))
+	for i, root := range roots {
+		if decoded, err := hex.DecodeString(root); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("Merkle root of shard %v is not a hex SHA-256 hash", i)
+		}
+		if leafCounts[i] <= 0 {
+			return nil, fmt.Errorf("chunk count of shard %v must be positive", i)
+		}
+		normalised[i] = strings.ToLower(root)
+	}
+
+	return normalised, nil
+}
+
+// VerifyMerkleProof checks that chunk is leaf leafIndex of the tree of leafCount leaves with
+// the given (hex) root. The proof is the (hex) sibling hashes from the leaf up to the root,
+// leaving out the levels where the node is carried up without a sibling.
+func VerifyMerkleProof(root string, leafCount int, leafIndex int, chunk []byte, proof []string) error {
+	if leafIndex < 0 || leafIndex >= leafCount {
+		return fmt.Errorf("leaf index out of range")
+	}
+
+	hash := merkleLeafHash(chunk)
+	index := leafIndex
+	width := leafCount
+	used := 0
+
+	for width > 1 {
+		isCarried := index == width-1 && width%2 == 1
+		if !isCarried {
+			if used >= len(proof) {
+				return fmt.Errorf("proof is too short")
+			}
+			sibling, err := hex.DecodeString(proof[used])
+			if err != nil {
+				return fmt.Errorf("invalid proof hash")
+			}
+			used++
+
+			if index%2 == 0 {
+				hash = merkleNodeHash(hash, sibling)
+			} else {
+				hash = merkleNodeHash(sibling, hash)
+			}
+		}
+
+		index /= 2
+		width = (width + 1) / 2
+	}
+
+	if used != len(proof) {
+		return fmt.Errorf("proof is too long")
+	}
+	if !strings.EqualFold(hex.EncodeToString(hash), root) {
+		return fmt.Errorf("proof does not match the shard's root")
+	}
+
+	return nil
+}
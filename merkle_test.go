@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// buildMerkleTree returns the levels of the tree over the chunks, leaves first.
+func buildMerkleTree(chunks [][]byte) [][][]byte {
+	level := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		level[i] = merkleLeafHash(chunk)
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// merkleProof returns the sibling hashes of the leaf, leaving out the levels where it is
+// carried up.
+func merkleProof(levels [][][]byte, leafIndex int) []string {
+	var proof []string
+	index := leafIndex
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, hex.EncodeToString(level[sibling]))
+		}
+		index /= 2
+	}
+
+	return proof
+}
+
+func TestVerifyMerkleProof(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	levels := buildMerkleTree(chunks)
+	root := hex.EncodeToString(levels[len(levels)-1][0])
+
+	// The root of five leaves, worked out by hand: ((a b) (c d)) e
+	ab := merkleNodeHash(merkleLeafHash(chunks[0]), merkleLeafHash(chunks[1]))
+	cd := merkleNodeHash(merkleLeafHash(chunks[2]), merkleLeafHash(chunks[3]))
+	if want := hex.EncodeToString(merkleNodeHash(merkleNodeHash(ab, cd), merkleLeafHash(chunks[4]))); root != want {
+		t.Fatalf("root = %v, want %v", root, want)
+	}
+
+	single := hex.EncodeToString(merkleLeafHash([]byte("only")))
+
+	tests := []struct {
+		name      string
+		root      string
+		leafCount int
+		leafIndex int
+		chunk     []byte
+		proof     []string
+		wantErr   bool
+	}{
+		{"first leaf", root, 5, 0, chunks[0], merkleProof(levels, 0), false},
+		{"odd leaf", root, 5, 3, chunks[3], merkleProof(levels, 3), false},
+		{"carried leaf", root, 5, 4, chunks[4], merkleProof(levels, 4), false},
+		{"uppercase root", strings.ToUpper(root), 5, 2, chunks[2], merkleProof(levels, 2), false},
+		{"single leaf", single, 1, 0, []byte("only"), nil, false},
+		{"wrong chunk", root, 5, 1, []byte("x"), merkleProof(levels, 1), true},
+		{"wrong index", root, 5, 1, chunks[0], merkleProof(levels, 0), true},
+		{"index out of range", root, 5, 5, chunks[4], merkleProof(levels, 4), true},
+		{"negative index", root, 5, -1, chunks[0], merkleProof(levels, 0), true},
+		{"proof too short", root, 5, 0, chunks[0], merkleProof(levels, 0)[:2], true},
+		{"proof too long", root, 5, 4, chunks[4], append(merkleProof(levels, 4), root), true},
+		{"proof not hex", root, 5, 0, chunks[0], []string{"zz", "zz", "zz"}, true},
+	}
+
+	for _, test := range tests {
+		err := VerifyMerkleProof(test.root, test.leafCount, test.leafIndex, test.chunk, test.proof)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: VerifyMerkleProof() error = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestNormaliseMerkleRoots(t *testing.T) {
+	root := hex.EncodeToString(merkleLeafHash([]byte("a")))
+
+	tests := []struct {
+		name       string
+		roots      []string
+		leafCounts []int
+		want       []string
+		wantErr    bool
+	}{
+		{"lowercase", []string{root}, []int{1}, []string{root}, false},
+		{"uppercase", []string{strings.ToUpper(root)}, []int{3}, []string{root}, false},
+		{"none", nil, nil, []string{}, false},
+		{"count missing", []string{root}, nil, nil, true},
+		{"not hex", []string{strings.Repeat("z", 64)}, []int{1}, nil, true},
+		{"too short", []string{root[:62]}, []int{1}, nil, true},
+		{"no chunks", []string{root}, []int{0}, nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := normaliseMerkleRoots(test.roots, test.leafCounts)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: normaliseMerkleRoots() error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%v: normaliseMerkleRoots() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+// MigrationJob moves a file between the storage pool and AWS. The uploader's node copies
+// the file to the new tier (to the hosts in Placement when moving to the storage pool) and
+// reports back, at which point the file's tier and the capacity counters are switched over.
+// When the server manages the object store, ObjectKey is the file's object in AWS and
+// ObjectURL a pre-signed URL to upload it to (or download it from), set when listed.
+type MigrationJob struct {
+	ID        string     `bson:"id" json:"id"`
+	FileID    string     `bson:"file_id" json:"file_id"`
+	FileName  string     `bson:"file_name" json:"file_name"`
+	Folder    string     `bson:"folder" json:"folder"`
+	Owner     string     `bson:"owner" json:"owner"` // the file's uploader, whose node does the copying
+	FromTier  string     `bson:"from_tier" json:"from_tier"`
+	ToTier    string     `bson:"to_tier" json:"to_tier"`
+	FileSize  float64    `bson:"file_size" json:"file_size"` // in gigabytes
+	Placement [][]string `bson:"placement,omitempty" json:"placement,omitempty"`
+	ObjectKey string     `bson:"object_key,omitempty" json:"object_key,omitempty"`
+	ObjectURL string     `bson:"-" json:"object_url,omitempty"`
+	Reason    string     `bson:"reason" json:"reason"`
+	Status    string     `bson:"status" json:"status"`
+	CreatedAt int64      `bson:"created_at" json:"created_at"` // in unix time
+	UpdatedAt int64      `bson:"updated_at" json:"updated_at"` // in unix time
+}
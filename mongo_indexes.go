@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CreateIndexes creates the indexes the server's queries rely on. Creating an index
+// that already exists is a no-op, so this is safe to call on every start.
+func CreateIndexes() error {
+	indexes := map[*mongo.Collection][]mongo.IndexModel{
+		networkHistoryColl: {
+			{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+		},
+		userDetailsColl: {
+			{Keys: bson.D{{Key: "user_name", Value: 1}}},
+		},
+		activeAlertsColl: {
+			{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		uploadedFilesColl: {
+			{Keys: bson.D{{Key: "file_name", Value: 1}}},
+			{Keys: bson.D{{Key: "uploader_username", Value: 1}, {Key: "folder", Value: 1}, {Key: "file_name", Value: 1}, {Key: "version", Value: -1}}},
+			{Keys: bson.D{{Key: "content_hash", Value: 1}, {Key: "is_reference", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "trashed_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "in_storage_pool", Value: 1}, {Key: "is_monthly_sub", Value: 1}, {Key: "file_size", Value: -1}}},
+			{Keys: bson.D{{Key: "object_key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+			{
+				Keys: bson.D{{Key: "uploader_username", Value: 1}, {Key: "folder", Value: 1}, {Key: "file_name", Value: 1}, {Key: "version", Value: 1}},
+				// Files recorded before versioning have no version and are left out
+				Options: options.Index().SetName(FILE_VERSION_INDEX_NAME).SetUnique(true).
+					SetPartialFilterExpression(bson.D{{Key: "version", Value: bson.D{{Key: "$gt", Value: 0}}}}),
+			},
+		},
+		repairJobsColl: {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "shard_index", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "source_host", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "target_host", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		storageChallengesColl: {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "host", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "deadline", Value: 1}}},
+		},
+		creditLedgerColl: {
+			{Keys: bson.D{{Key: "user_name", Value: 1}, {Key: "period_end", Value: -1}}},
+			{Keys: bson.D{{Key: "period_end", Value: -1}}},
+		},
+		foldersColl: {
+			{Keys: bson.D{{Key: "user_name", Value: 1}, {Key: "path", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		shareGrantsColl: {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "folder", Value: 1}, {Key: "file_name", Value: 1}}},
+			{Keys: bson.D{{Key: "grantee", Value: 1}}},
+			{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetSparse(true)},
+		},
+		keyEnvelopesColl: {
+			{Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "recipient", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "id", Value: 1}}},
+		},
+		migrationJobsColl: {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		},
+		shardPurgesColl: {
+			{Keys: bson.D{{Key: "host", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "created_at", Value: 1}}},
+		},
+		dedupChallengesColl: {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+		},
+		corruptionReportsColl: {
+			{Keys: bson.D{{Key: "file_id", Value: 1}}},
+			{Keys: bson.D{{Key: "challenge_id", Value: 1}}},
+		},
+		introductionsColl: {
+			{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "from", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "to", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		hostsColl: {
+			{Keys: bson.D{{Key: "user_name", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{
+				Keys: bson.D{{Key: "address", Value: 1}},
+				// Hosts without an address are left out
+				Options: options.Index().SetName(HOST_ADDRESS_INDEX_NAME).SetUnique(true).
+					SetPartialFilterExpression(bson.D{{Key: "address", Value: bson.D{{Key: "$gt", Value: ""}}}}),
+			},
+			{Keys: bson.D{{Key: "last_heartbeat", Value: 1}}},
+			{Keys: bson.D{{Key: "timezone", Value: 1}, {Key: "last_heartbeat", Value: 1}}},
+			{Keys: bson.D{{Key: "free_space", Value: 1}}},
+		},
+	}
+
+	for coll, models := range indexes {
+		if _, err := coll.Indexes().CreateMany(context.Background(), models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
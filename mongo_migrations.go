@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyFileFields maps the field names uploaded files were stored under before
+// UploadedFile had bson tags (the driver's default, lowercased Go names) to their
+// current names.
+var legacyFileFields = bson.D{
+	{Key: "filename", Value: "file_name"},
+	{Key: "filesize", Value: "file_size"},
+	{Key: "uploaddate", Value: "upload_date"},
+	{Key: "instoragepool", Value: "in_storage_pool"},
+	{Key: "uploaderusername", Value: "uploader_username"},
+	{Key: "backupshards", Value: "backup_shards"},
+	{Key: "ismonthlysub", Value: "is_monthly_sub"},
+}
+
+// MigrateLegacyFileFields renames the fields of uploaded files stored under their legacy
+// names. Documents that have already been migrated do not match, so this is safe to call
+// on every start.
+func MigrateLegacyFileFields() error {
+	or := bson.A{}
+	for _, field := range legacyFileFields {
+		or = append(or, bson.D{{Key: field.Key, Value: bson.D{{Key: "$exists", Value: true}}}})
+	}
+
+	update := bson.D{{Key: "$rename", Value: legacyFileFields}}
+	result, err := uploadedFilesColl.UpdateMany(context.Background(), bson.D{{Key: "$or", Value: or}}, update)
+	if err != nil {
+		return err
+	}
+
+	if result.ModifiedCount > 0 {
+		log.Printf("Migrated %v uploaded files to the current field names\n", result.ModifiedCount)
+	}
+	return nil
+}
+
+// MigrateDuplicateFileVersions renumbers the file versions that share their number with
+// another version of the same file, as concurrent uploads could record before version
+// numbers were unique. The earliest record keeps the number and the others are numbered
+// after the file's last version, so that the unique version index can be built.
+func MigrateDuplicateFileVersions() error {
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "version", Value: bson.D{{Key: "$gt", Value: 0}}}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "uploader_username", Value: "$uploader_username"},
+				{Key: "folder", Value: "$folder"},
+				{Key: "file_name", Value: "$file_name"},
+				{Key: "version", Value: "$version"},
+			}},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	}
+
+	cursor, err := uploadedFilesColl.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return err
+	}
+
+	var duplicates []struct {
+		File struct {
+			UploaderUsername string `bson:"uploader_username"`
+			Folder           string `bson:"folder"`
+			FileName         string `bson:"file_name"`
+		} `bson:"_id"`
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(context.Background(), &duplicates); err != nil {
+		return err
+	}
+
+	renumbered := 0
+	for _, duplicate := range duplicates {
+		file := duplicate.File
+		filter := bson.D{
+			{Key: "uploader_username", Value: file.UploaderUsername},
+			folderMatch(CleanFolderPath(file.Folder)),
+			{Key: "file_name", Value: file.FileName},
+		}
+
+		var last UploadedFile
+		opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+		if err := uploadedFilesColl.FindOne(context.Background(), filter, opts).Decode(&last); err != nil {
+			return err
+		}
+
+		for i, id := range duplicate.IDs[1:] {
+			update := bson.D{{Key: "$set", Value: bson.D{{Key: "version", Value: last.Version + i + 1}}}}
+			if _, err := uploadedFilesColl.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: id}}, update); err != nil {
+				return err
+			}
+			renumbered++
+		}
+
+		if err := markLatestFileVersion(file.UploaderUsername, file.Folder, file.FileName); err != nil {
+			return err
+		}
+	}
+
+	if renumbered > 0 {
+		log.Printf("Renumbered %v file versions that shared their number with another version\n", renumbered)
+	}
+	return nil
+}
+
+// MigrateDuplicateHostAddresses clears the address of every host but the one heard from
+// last among hosts sharing an address, as nothing stopped before addresses were unique, and
+// drops the old non-unique address index. The cleared hosts set their address again with
+// their next heartbeat.
+func MigrateDuplicateHostAddresses() error {
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "address", Value: bson.D{{Key: "$gt", Value: ""}}}}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "last_heartbeat", Value: -1}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$address"},
+			{Key: "users", Value: bson.D{{Key: "$push", Value: "$user_name"}}},
+		}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "users.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	}
+
+	cursor, err := hostsColl.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return err
+	}
+
+	var duplicates []struct {
+		Address string   `bson:"_id"`
+		Users   []string `bson:"users"`
+	}
+	if err := cursor.All(context.Background(), &duplicates); err != nil {
+		return err
+	}
+
+	for _, duplicate := range duplicates {
+		filter := bson.D{{Key: "user_name", Value: bson.D{{Key: "$in", Value: duplicate.Users[1:]}}}}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "address", Value: ""}}}}
+		if _, err := hostsColl.UpdateMany(context.Background(), filter, update); err != nil {
+			return err
+		}
+		log.Printf("Cleared address %v of %v hosts also using it\n", duplicate.Address, len(duplicate.Users)-1)
+	}
+
+	// The unique index has the same keys, which Mongo does not allow next to the old one.
+	// Once it is gone, or before there are any hosts, there is nothing to drop.
+	if _, err := hostsColl.Indexes().DropOne(context.Background(), "address_1"); err != nil {
+		if commandErr, ok := err.(mongo.CommandError); !ok || (!commandErr.HasErrorCode(27) && !commandErr.HasErrorCode(26)) {
+			return err
+		}
+	}
+
+	return nil
+}
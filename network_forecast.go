@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// NetworkForecast predicts when the storage pool and the AWS allocation will run out,
+// based on the growth trend in the network history.
+type NetworkForecast struct {
+	GeneratedAt int64            `json:"generated_at"` // in unix time
+	Samples     int              `json:"samples"`
+	StoragePool ResourceForecast `json:"storage_pool"`
+	Aws         ResourceForecast `json:"aws"`
+
+	// FixedAmountDemand is the storage owed to fixed amount customers, which the
+	// storage pool should be able to hold (in gigabytes).
+	FixedAmountDemand float64 `json:"fixed_amount_demand"`
+
+	// MonthlySubsNeeded is the number of additional monthly subscribers needed for the
+	// storage pool to cover the fixed amount demand now, and HorizonMonthlySubsNeeded
+	// is the same figure at the end of the forecast horizon if current trends continue.
+	MonthlySubsNeeded        int64 `json:"monthly_subs_needed"`
+	HorizonDays              int64 `json:"horizon_days"`
+	HorizonMonthlySubsNeeded int64 `json:"horizon_monthly_subs_needed"`
+}
+
+// ResourceForecast is the trend of a single storage resource. ExhaustedAt is nil when
+// the resource is not expected to run out, because its size grows at least as fast
+// as its usage.
+type ResourceForecast struct {
+	Size               float64  `json:"size"`                // in gigabytes
+	Used               float64  `json:"used"`                // in gigabytes
+	SizeGrowthPerDay   float64  `json:"size_growth_per_day"` // in gigabytes
+	UsedGrowthPerDay   float64  `json:"used_growth_per_day"` // in gigabytes
+	ExhaustedAt        *int64   `json:"exhausted_at"`        // in unix time
+	DaysUntilExhausted *float64 `json:"days_until_exhausted"`
+}
+
+// GetNetworkForecast fits a linear trend to the last windowDays of network history and
+// uses it to forecast capacity exhaustion and subscriber demand horizonDays ahead.
+func GetNetworkForecast(windowDays int64, horizonDays int64) (NetworkForecast, error) {
+	now := time.Now().Unix()
+
+	snapshots, err := GetNetworkStateSnapshots(now-windowDays*24*60*60, now)
+	if err != nil {
+		return NetworkForecast{}, err
+	}
+
+	var current NetworkStorageState
+	if err := findNetworkStateInMongo(&current); err != nil {
+		return NetworkForecast{}, err
+	}
+
+	// Make sure the trend ends at the current state, not at the last snapshot
+	snapshots = append(snapshots, NetworkStateSnapshot{Timestamp: now, State: current})
+
+	if len(snapshots) < 2 || snapshots[len(snapshots)-1].Timestamp == snapshots[0].Timestamp {
+		return NetworkForecast{}, fmt.Errorf("not enough network history to forecast")
+	}
+
+	trend := func(value func(NetworkStorageState) float64) float64 {
+		xs := make([]float64, len(snapshots))
+		ys := make([]float64, len(snapshots))
+		for i, snapshot := range snapshots {
+			xs[i] = float64(snapshot.Timestamp-now) / (24 * 60 * 60)
+			ys[i] = value(snapshot.State)
+		}
+		return linearSlope(xs, ys)
+	}
+
+	forecast := NetworkForecast{
+		GeneratedAt: now,
+		Samples:     len(snapshots),
+		HorizonDays: horizonDays,
+		StoragePool: newResourceForecast(now,
+			current.TotalStoragePoolSize, current.TotalStoragePoolUsed,
+			trend(func(s NetworkStorageState) float64 { return s.TotalStoragePoolSize }),
+			trend(func(s NetworkStorageState) float64 { return s.TotalStoragePoolUsed })),
+		Aws: newResourceForecast(now,
+			current.TotalAwsStorageSize, current.TotalAwsStorageUsed,
+			trend(func(s NetworkStorageState) float64 { return s.TotalAwsStorageSize }),
+			trend(func(s NetworkStorageState) float64 { return s.TotalAwsStorageUsed })),
+	}
+
+	forecast.FixedAmountDemand = fixedAmountDemand(float64(current.NumberOfFixedAmount1Subs), float64(current.NumberOfFixedAmount2Subs))
+	forecast.MonthlySubsNeeded = monthlySubsNeeded(forecast.FixedAmountDemand, current.TotalStoragePoolSize)
+
+	days := float64(horizonDays)
+	horizonDemand := fixedAmountDemand(
+		math.Max(0, float64(current.NumberOfFixedAmount1Subs)+days*trend(func(s NetworkStorageState) float64 { return float64(s.NumberOfFixedAmount1Subs) })),
+		math.Max(0, float64(current.NumberOfFixedAmount2Subs)+days*trend(func(s NetworkStorageState) float64 { return float64(s.NumberOfFixedAmount2Subs) })),
+	)
+	horizonPoolSize := current.TotalStoragePoolSize + days*forecast.StoragePool.SizeGrowthPerDay
+	forecast.HorizonMonthlySubsNeeded = monthlySubsNeeded(horizonDemand, horizonPoolSize)
+
+	return forecast, nil
+}
+
+// newResourceForecast works out when used will catch up with size given their growth per day.
+func newResourceForecast(now int64, size float64, used float64, sizeGrowth float64, usedGrowth float64) ResourceForecast {
+	forecast := ResourceForecast{
+		Size:             size,
+		Used:             used,
+		SizeGrowthPerDay: sizeGrowth,
+		UsedGrowthPerDay: usedGrowth,
+	}
+
+	var days float64
+	if used >= size {
+		days = 0
+	} else if usedGrowth > sizeGrowth {
+		days = (size - used) / (usedGrowth - sizeGrowth)
+	} else {
+		return forecast
+	}
+
+	exhaustedAt := now + int64(days*24*60*60)
+	forecast.ExhaustedAt = &exhaustedAt
+	forecast.DaysUntilExhausted = &days
+
+	return forecast
+}
+
+// fixedAmountDemand returns the storage owed to the given number of fixed amount customers.
+func fixedAmountDemand(fixedAmount1Subs float64, fixedAmount2Subs float64) float64 {
+	return fixedAmount1Subs*FIXED_AMOUNT_1_STORAGE_SIZE + fixedAmount2Subs*FIXED_AMOUNT_2_STORAGE_SIZE
+}
+
+// monthlySubsNeeded returns how many more monthly subscribers are needed for the storage
+// pool to hold the given demand.
+func monthlySubsNeeded(demand float64, storagePoolSize float64) int64 {
+	if demand <= storagePoolSize {
+		return 0
+	}
+
+	return int64(math.Ceil((demand - storagePoolSize) / MONTHLY_STORAGE_ALLOCATION_SIZE))
+}
+
+// linearSlope returns the least squares slope of ys against xs.
+func linearSlope(xs []float64, ys []float64) float64 {
+	n := float64(len(xs))
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator
+}
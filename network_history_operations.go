@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RecordNetworkStateSnapshot stores the current network storage state in the history collection.
+func RecordNetworkStateSnapshot() error {
+	var state NetworkStorageState
+	if err := findNetworkStateInMongo(&state); err != nil {
+		return err
+	}
+
+	snapshot := NetworkStateSnapshot{
+		Timestamp: time.Now().Unix(),
+		State:     state,
+	}
+
+	if _, err := networkHistoryColl.InsertOne(context.Background(), snapshot); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RunNetworkHistorySnapshots records a network state snapshot every interval. It blocks
+// and is meant to be run in its own goroutine.
+func RunNetworkHistorySnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := RecordNetworkStateSnapshot(); err != nil {
+			log.Println("Unable to record network state snapshot:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// GetNetworkStateSnapshots returns the snapshots taken between from and to (inclusive,
+// in unix time), oldest first.
+func GetNetworkStateSnapshots(from int64, to int64) ([]NetworkStateSnapshot, error) {
+	filter := bson.D{{Key: "timestamp", Value: bson.D{
+		{Key: "$gte", Value: from},
+		{Key: "$lte", Value: to},
+	}}}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+
+	cursor, err := networkHistoryColl.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []NetworkStateSnapshot
+	if err := cursor.All(context.Background(), &snapshots); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// GetNetworkHistory returns the network storage history between from and to, downsampled
+// so that there is at most one point per step seconds. Steps without snapshots are omitted.
+// The snapshots are averaged into steps by Mongo, so only the points are read.
+func GetNetworkHistory(from int64, to int64, step int64) ([]NetworkHistoryPoint, error) {
+	if to < from {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if (to-from)/step > NETWORK_HISTORY_MAX_POINTS {
+		return nil, fmt.Errorf("too many points requested, maximum is %v", NETWORK_HISTORY_MAX_POINTS)
+	}
+
+	// Each snapshot goes in the step starting at from + floor((timestamp - from) / step) * step
+	bucketStart := bson.D{{Key: "$subtract", Value: bson.A{
+		"$timestamp",
+		bson.D{{Key: "$mod", Value: bson.A{bson.D{{Key: "$subtract", Value: bson.A{"$timestamp", from}}}, step}}},
+	}}}
+	average := func(field string) bson.D {
+		return bson.D{{Key: "$avg", Value: "$state." + field}}
+	}
+
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: from},
+			{Key: "$lte", Value: to},
+		}}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bucketStart},
+			{Key: "samples", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "number_of_monthly_subs", Value: average("number_of_monthly_subs")},
+			{Key: "number_of_fixed_amount1_subs", Value: average("number_of_fixed_amount1_subs")},
+			{Key: "number_of_fixed_amount2_subs", Value: average("number_of_fixed_amount2_subs")},
+			{Key: "total_aws_storage_size", Value: average("total_aws_storage_size")},
+			{Key: "total_aws_storage_used", Value: average("total_aws_storage_used")},
+			{Key: "total_storage_pool_size", Value: average("total_storage_pool_size")},
+			{Key: "total_storage_pool_used", Value: average("total_storage_pool_used")},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+
+	cursor, err := networkHistoryColl.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []struct {
+		Timestamp                int64   `bson:"_id"`
+		Samples                  int     `bson:"samples"`
+		NumberOfMonthlySubs      float64 `bson:"number_of_monthly_subs"`
+		NumberOfFixedAmount1Subs float64 `bson:"number_of_fixed_amount1_subs"`
+		NumberOfFixedAmount2Subs float64 `bson:"number_of_fixed_amount2_subs"`
+		TotalAwsStorageSize      float64 `bson:"total_aws_storage_size"`
+		TotalAwsStorageUsed      float64 `bson:"total_aws_storage_used"`
+		TotalStoragePoolSize     float64 `bson:"total_storage_pool_size"`
+		TotalStoragePoolUsed     float64 `bson:"total_storage_pool_used"`
+	}
+	if err := cursor.All(context.Background(), &buckets); err != nil {
+		return nil, err
+	}
+
+	points := make([]NetworkHistoryPoint, len(buckets))
+	for i, bucket := range buckets {
+		points[i] = NetworkHistoryPoint(bucket)
+	}
+
+	return points, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NetworkOverview is the complete network storage state along with the values derived
+// from it, all taken from a single read so that they are consistent with each other.
+type NetworkOverview struct {
+	State              NetworkStorageState `json:"state"`
+	FreeStoragePool    float64             `json:"free_storage_pool"`     // in gigabytes
+	FreeAwsStorage     float64             `json:"free_aws_storage"`      // in gigabytes
+	StoragePoolUsedPct float64             `json:"storage_pool_used_pct"` // 0-100
+	AwsStorageUsedPct  float64             `json:"aws_storage_used_pct"`  // 0-100
+	Subscribers        SubscriberBreakdown `json:"subscribers"`
+}
+
+// SubscriberBreakdown is the number of customers on each account type.
+type SubscriberBreakdown struct {
+	Monthly      int64 `json:"monthly"`
+	FixedAmount1 int64 `json:"fixed_amount_1"`
+	FixedAmount2 int64 `json:"fixed_amount_2"`
+	Total        int64 `json:"total"`
+}
+
+// GetNetworkOverview reads the network storage state once and derives the free
+// capacity, utilisation and subscriber figures from it.
+func GetNetworkOverview() (NetworkOverview, error) {
+	var state NetworkStorageState
+	err := findNetworkStateInMongo(&state)
+
+	if err == mongo.ErrNoDocuments {
+		return NetworkOverview{}, fmt.Errorf("Network storage state has not been initialised")
+	}
+	if err != nil {
+		return NetworkOverview{}, err
+	}
+
+	return NewNetworkOverview(state), nil
+}
+
+// NewNetworkOverview derives the network overview from the given network storage state.
+func NewNetworkOverview(state NetworkStorageState) NetworkOverview {
+	return NetworkOverview{
+		State:              state,
+		FreeStoragePool:    state.TotalStoragePoolSize - state.TotalStoragePoolUsed,
+		FreeAwsStorage:     state.TotalAwsStorageSize - state.TotalAwsStorageUsed,
+		StoragePoolUsedPct: percentage(state.TotalStoragePoolUsed, state.TotalStoragePoolSize),
+		AwsStorageUsedPct:  percentage(state.TotalAwsStorageUsed, state.TotalAwsStorageSize),
+		Subscribers: SubscriberBreakdown{
+			Monthly:      state.NumberOfMonthlySubs,
+			FixedAmount1: state.NumberOfFixedAmount1Subs,
+			FixedAmount2: state.NumberOfFixedAmount2Subs,
+			Total:        state.NumberOfMonthlySubs + state.NumberOfFixedAmount1Subs + state.NumberOfFixedAmount2Subs,
+		},
+	}
+}
+
+// percentage returns used as a percentage of size, or 0 if size is not positive.
+func percentage(used float64, size float64) float64 {
+	if size <= 0 {
+		return 0
+	}
+
+	return used / size * 100
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// NetworkStateEvent is a snapshot of the network storage state taken after one of
+// the network counters changed. The ID is used by SSE clients to resume a stream.
+type NetworkStateEvent struct {
+	ID    int64
+	State NetworkStorageState
+}
+
+// networkStateBroker fans out network state changes to the connected SSE clients
+// and keeps the most recent events so that reconnecting clients can catch up.
+type networkStateBroker struct {
+	mu          sync.Mutex
+	lastID      int64
+	recent      []NetworkStateEvent
+	subscribers map[chan NetworkStateEvent]struct{}
+}
+
+var networkStateEvents = &networkStateBroker{
+	subscribers: make(map[chan NetworkStateEvent]struct{}),
+}
+
+// Subscribe registers a new listener. It returns the channel events are delivered on
+// and the events newer than lastEventID that the listener has missed. If lastEventID
+// is no longer buffered, resumed is false and the caller should send a fresh snapshot.
+func (b *networkStateBroker) Subscribe(lastEventID int64) (ch chan NetworkStateEvent, missed []NetworkStateEvent, resumed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch = make(chan NetworkStateEvent, NETWORK_STATE_EVENT_BUFFER_SIZE)
+	b.subscribers[ch] = struct{}{}
+
+	if lastEventID <= 0 || lastEventID > b.lastID {
+		return ch, nil, false
+	}
+
+	for i, event := range b.recent {
+		if event.ID == lastEventID {
+			missed = append(missed, b.recent[i+1:]...)
+			return ch, missed, true
+		}
+	}
+
+	return ch, nil, false
+}
+
+// Unsubscribe removes a listener and closes its channel.
+func (b *networkStateBroker) Unsubscribe(ch chan NetworkStateEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish records the state as a new event and sends it to every listener. Slow
+// listeners whose buffer is full are skipped rather than blocking the publisher.
+func (b *networkStateBroker) Publish(state NetworkStorageState) NetworkStateEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event := NetworkStateEvent{ID: b.lastID, State: state}
+
+	b.recent = append(b.recent, event)
+	if len(b.recent) > NETWORK_STATE_EVENT_BUFFER_SIZE {
+		b.recent = b.recent[len(b.recent)-NETWORK_STATE_EVENT_BUFFER_SIZE:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Println("Dropping network state event for slow subscriber")
+		}
+	}
+
+	return event
+}
+
+// LastEventID returns the ID of the most recently published event.
+func (b *networkStateBroker) LastEventID() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastID
+}
+
+// notifyNetworkStateChanged reads the current network storage state and publishes it
+// to the SSE subscribers, then has the alert rules re-evaluated. It is called after every
+// change to the network counters.
+func notifyNetworkStateChanged() {
+	var state NetworkStorageState
+	if err := findNetworkStateInMongo(&state); err != nil {
+		log.Println("Unable to read network storage state:", err)
+		return
+	}
+
+	networkStateEvents.Publish(state)
+	TriggerNetworkAlertEvaluation()
+}
@@ -0,0 +1,21 @@
+package main
+
+// NetworkStateSnapshot is a copy of the network storage state taken at a point in time.
+type NetworkStateSnapshot struct {
+	Timestamp int64               `bson:"timestamp"` // in unix time
+	State     NetworkStorageState `bson:"state"`
+}
+
+// NetworkHistoryPoint is one downsampled point of the network storage history. Every
+// value is the average of the snapshots taken during the step starting at Timestamp.
+type NetworkHistoryPoint struct {
+	Timestamp                int64   `json:"timestamp"` // in unix time
+	Samples                  int     `json:"samples"`
+	NumberOfMonthlySubs      float64 `json:"number_of_monthly_subs"`
+	NumberOfFixedAmount1Subs float64 `json:"number_of_fixed_amount1_subs"`
+	NumberOfFixedAmount2Subs float64 `json:"number_of_fixed_amount2_subs"`
+	TotalAwsStorageSize      float64 `json:"total_aws_storage_size"`  // in gigabytes
+	TotalAwsStorageUsed      float64 `json:"total_aws_storage_used"`  // in gigabytes
+	TotalStoragePoolSize     float64 `json:"total_storage_pool_size"` // in gigabytes
+	TotalStoragePoolUsed     float64 `json:"total_storage_pool_used"` // in gigabytes
+}
@@ -33,6 +33,8 @@ func InitialiseNetworkState() {
 	}
 
 	fmt.Printf("Document inserted with ID: %s\n", result.InsertedID)
+
+	notifyNetworkStateChanged()
 }
 
 func findNetworkStateInMongo(v *NetworkStorageState) error {
@@ -84,6 +86,8 @@ func IncrementTotalAwsStorageSize(size float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, err
 }
 
@@ -99,6 +103,8 @@ func DecrementTotalAwsStorageSize(size float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, err
 }
 
@@ -114,6 +120,8 @@ func DecrementAwsStorageUsed(size float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, err
 }
 
@@ -130,6 +138,8 @@ func IncrementTotalStoragePoolSize(size float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, err
 }
 
@@ -145,6 +155,8 @@ func DecrementTotalStoragePoolSize(size float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, err
 }
 
@@ -160,6 +172,8 @@ func DecrementStoragePoolUsed(size float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, err
 }
 
@@ -176,6 +190,8 @@ func IncrementStoragePoolUsed(increment float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, nil
 }
 
@@ -192,6 +208,8 @@ func IncrementAwsStorageUsed(increment float64) (bool, error) {
 		return false, err
 	}
 
+	notifyNetworkStateChanged()
+
 	return true, nil
 }
 
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ObjectStore stores the files in the AWS tier. Clients never hold the store's credentials:
+// the server hands them pre-signed URLs to upload and download individual objects with.
+type ObjectStore interface {
+	// PresignPut returns a URL the object can be uploaded to with a PUT request until expiry
+	PresignPut(key string, expiry time.Duration) (string, error)
+
+	// PresignGet returns a URL the object can be downloaded from with a GET request until expiry
+	PresignGet(key string, expiry time.Duration) (string, error)
+
+	// Delete deletes the object, if it exists
+	Delete(key string) error
+}
+
+// objectStore is the store of the AWS tier, or nil if none is configured, in which case
+// clients store AWS tier files themselves.
+var objectStore ObjectStore
+
+// ObjectStoreFromEnv returns the object store configured by SHR_OBJECT_STORE ("s3" or
+// "local"), or nil if none is.
+func ObjectStoreFromEnv() ObjectStore {
+	switch os.Getenv("SHR_OBJECT_STORE") {
+	case "":
+		return nil
+
+	case "s3":
+		store := &S3ObjectStore{
+			Endpoint:        os.Getenv("SHR_S3_ENDPOINT"),
+			Region:          os.Getenv("SHR_S3_REGION"),
+			Bucket:          os.Getenv("SHR_S3_BUCKET"),
+			AccessKeyID:     os.Getenv("SHR_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("SHR_S3_SECRET_ACCESS_KEY"),
+			PathStyle:       os.Getenv("SHR_S3_PATH_STYLE") == "true",
+		}
+		if store.Endpoint == "" {
+			store.Endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", store.Region)
+		}
+
+		if store.Region == "" || store.Bucket == "" || store.AccessKeyID == "" || store.SecretAccessKey == "" {
+			log.Println("SHR_S3_REGION, SHR_S3_BUCKET, SHR_S3_ACCESS_KEY_ID and SHR_S3_SECRET_ACCESS_KEY must be set, object store disabled")
+			return nil
+		}
+		return store
+
+	case "local":
+		store, err := NewLocalObjectStore(os.Getenv("SHR_LOCAL_OBJECT_DIR"), os.Getenv("SHR_LOCAL_OBJECT_URL"))
+		if err != nil {
+			log.Println("Unable to create local object store, object store disabled:", err)
+			return nil
+		}
+		return store
+
+	default:
+		log.Printf("Unknown object store [%v], object store disabled\n", os.Getenv("SHR_OBJECT_STORE"))
+		return nil
+	}
+}
+
+// deleteStoredObject deletes the object from the object store, if there is one and no
+// file record uses it, logging any error.
+func deleteStoredObject(key string) {
+	if key == "" || objectStore == nil {
+		return
+	}
+
+	if count, err := uploadedFilesColl.CountDocuments(context.Background(), bson.D{{Key: "object_key", Value: key}}); err != nil {
+		log.Printf("Unable to check whether object %v is in use: %v\n", key, err)
+		return
+	} else if count > 0 {
+		return
+	}
+
+	if err := objectStore.Delete(key); err != nil {
+		log.Printf("Unable to delete object %v: %v\n", key, err)
+	}
+}
+
+// newObjectKey returns a new key for an object of the user.
+func newObjectKey(username string) string {
+	return username + "/" + primitive.NewObjectID().Hex()
+}
+
+// isObjectKeyOf reports whether the key belongs to the user, so that users cannot record
+// files pointing at other users' objects.
+func isObjectKeyOf(key string, username string) bool {
+	return strings.HasPrefix(key, username+"/") && !strings.Contains(key, "..")
+}
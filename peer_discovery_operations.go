@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PeerQuery describes the peers a node is looking for.
+type PeerQuery struct {
+	Amount       int
+	Exclude      string   // username of the caller, never returned
+	Statuses     []string // host statuses to accept, defaults to online
+	Timezones    []string // timezones to accept, any if empty
+	MinFreeSpace float64  // in gigabytes
+}
+
+// DiscoverPeers returns up to query.Amount distinct random hosts matching the query. Each
+// query is given at most PEER_DISCOVERY_MAX_TIME to run, see sampleDistinct.
+func DiscoverPeers(query PeerQuery) ([]Host, error) {
+	now := time.Now().Unix()
+
+	statuses := query.Statuses
+	if len(statuses) == 0 {
+		statuses = []string{HOST_ONLINE}
+	}
+
+	var statusConditions bson.A
+	for _, status := range statuses {
+		condition, err := hostStatusFilter(status, now)
+		if err != nil {
+			return nil, err
+		}
+		statusConditions = append(statusConditions, condition)
+	}
+
+	match := bson.D{{Key: "$or", Value: statusConditions}}
+	if query.Exclude != "" {
+		match = append(match, bson.E{Key: "user_name", Value: bson.D{{Key: "$ne", Value: query.Exclude}}})
+	}
+	if len(query.Timezones) > 0 {
+		match = append(match, bson.E{Key: "timezone", Value: bson.D{{Key: "$in", Value: query.Timezones}}})
+	}
+	if query.MinFreeSpace > 0 {
+		match = append(match, bson.E{Key: "free_space", Value: bson.D{{Key: "$gte", Value: query.MinFreeSpace}}})
+	}
+
+	var hosts []Host
+	if err := sampleDistinct(hostsColl, match, query.Amount, &hosts); err != nil {
+		return nil, err
+	}
+
+	for i := range hosts {
+		hosts[i].Status = hostStatus(hosts[i].LastHeartbeat, now)
+	}
+
+	return hosts, nil
+}
+
+// sampleDistinct decodes up to amount distinct random documents matching the filter into
+// results. $sample only reads random documents straight off the collection when it is the
+// first stage, rather than scanning and sorting every match, so documents are sampled
+// first and filtered afterwards. $sample can return the same document twice and the
+// filter drops some, so more documents are sampled than asked for, over a few rounds if
+// needed. If that still comes up short, as with selective filters on a large collection,
+// the rest are sampled from the matches of an indexed query instead.
+func sampleDistinct(coll *mongo.Collection, match bson.D, amount int, results interface{}) error {
+	if amount > PEER_DISCOVERY_MAX_AMOUNT {
+		return fmt.Errorf("at most %v can be asked for", PEER_DISCOVERY_MAX_AMOUNT)
+	}
+
+	pipeline := bson.A{
+		bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: amount * PEER_DISCOVERY_OVERSAMPLE}}}},
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	opts := options.Aggregate().SetMaxTime(PEER_DISCOVERY_MAX_TIME)
+
+	seen := make(map[interface{}]bool)
+	ids := bson.A{}
+	for round := 0; round < PEER_DISCOVERY_SAMPLE_ROUNDS && len(ids) < amount; round++ {
+		cursor, err := coll.Aggregate(context.Background(), pipeline, opts)
+		if err != nil {
+			return err
+		}
+
+		var sampled []struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.All(context.Background(), &sampled); err != nil {
+			return err
+		}
+
+		for _, doc := range sampled {
+			if !seen[doc.ID] && len(ids) < amount {
+				seen[doc.ID] = true
+				ids = append(ids, doc.ID)
+			}
+		}
+	}
+
+	if len(ids) < amount {
+		fallback := bson.A{
+			bson.D{{Key: "$match", Value: append(match, bson.E{Key: "_id", Value: bson.D{{Key: "$nin", Value: ids}}})}},
+			bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: amount - len(ids)}}}},
+			bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}
+
+		cursor, err := coll.Aggregate(context.Background(), fallback, opts)
+		if err != nil {
+			return err
+		}
+
+		var sampled []struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.All(context.Background(), &sampled); err != nil {
+			return err
+		}
+
+		// $sample after $match sorts the matches randomly, so they are distinct already
+		for _, doc := range sampled {
+			ids = append(ids, doc.ID)
+		}
+	}
+
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+	cursor, err := coll.Find(context.Background(), filter, options.Find().SetMaxTime(PEER_DISCOVERY_MAX_TIME))
+	if err != nil {
+		return err
+	}
+
+	return cursor.All(context.Background(), results)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// configuredRelays returns the relay addresses from SHR_RELAYS (comma separated).
+func configuredRelays() []string {
+	var relays []string
+	for _, relay := range strings.Split(os.Getenv("SHR_RELAYS"), ",") {
+		if relay = strings.TrimSpace(relay); relay != "" {
+			relays = append(relays, relay)
+		}
+	}
+
+	return relays
+}
+
+// assignRelay returns the configured relay for a node that did not choose one. The same
+// node is always given the same relay while the configured relays do not change.
+func assignRelay(username string) string {
+	relays := configuredRelays()
+	if len(relays) == 0 {
+		return ""
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(username))
+
+	return relays[hash.Sum32()%uint32(len(relays))]
+}
+
+// RegisterEndpoints records the addresses the node can currently be reached at and the
+// relay it is attached to. If the node does not give a relay, one is assigned to it. The
+// node must have a host registry entry, i.e. have sent a heartbeat.
+func RegisterEndpoints(username string, endpoints []string, relayAddress string) (Host, error) {
+	if len(endpoints) == 0 {
+		return Host{}, fmt.Errorf("no endpoints provided")
+	}
+
+	if relayAddress == "" {
+		relayAddress = assignRelay(username)
+	}
+
+	filter := bson.D{{Key: "user_name", Value: username}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "endpoints", Value: endpoints},
+		{Key: "endpoints_updated_at", Value: time.Now().Unix()},
+		{Key: "relay_address", Value: relayAddress},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var host Host
+	if err := hostsColl.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&host); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Host{}, fmt.Errorf("host not registered, send a heartbeat first")
+		}
+		return Host{}, err
+	}
+	host.Status = hostStatus(host.LastHeartbeat, time.Now().Unix())
+
+	// Keep the user's relay address in step with the relay the node is attached to
+	userUpdate := bson.D{{Key: "$set", Value: bson.D{{Key: "relay_address", Value: relayAddress}}}}
+	if _, err := userDetailsColl.UpdateOne(context.Background(), filter, userUpdate); err != nil {
+		return Host{}, err
+	}
+
+	return host, nil
+}
+
+// RequestIntroduction starts brokering a connection from one node to another.
+func RequestIntroduction(from string, to string) (Introduction, error) {
+	if from == to {
+		return Introduction{}, fmt.Errorf("a node cannot be introduced to itself")
+	}
+
+	var fromHost, toHost Host
+	if err := hostsColl.FindOne(context.Background(), bson.D{{Key: "user_name", Value: from}}).Decode(&fromHost); err != nil {
+		return Introduction{}, fmt.Errorf("requesting node has not registered its endpoints")
+	}
+	if err := hostsColl.FindOne(context.Background(), bson.D{{Key: "user_name", Value: to}}).Decode(&toHost); err != nil {
+		return Introduction{}, fmt.Errorf("user [%v] is not a registered node", to)
+	}
+
+	now := time.Now()
+	if hostStatus(toHost.LastHeartbeat, now.Unix()) != HOST_ONLINE {
+		return Introduction{}, fmt.Errorf("user [%v] is not online", to)
+	}
+	if len(fromHost.Endpoints) == 0 || len(toHost.Endpoints) == 0 {
+		return Introduction{}, fmt.Errorf("both nodes must register their endpoints first")
+	}
+
+	introduction := Introduction{
+		ID:            primitive.NewObjectID().Hex(),
+		From:          from,
+		To:            to,
+		FromEndpoints: fromHost.Endpoints,
+		ToEndpoints:   toHost.Endpoints,
+		Stage:         RENDEZVOUS_STAGE_DIRECT,
+		Status:        RENDEZVOUS_PENDING,
+		CreatedAt:     now.Unix(),
+		ExpiresAt:     now.Add(RENDEZVOUS_INTRODUCTION_TTL).Unix(),
+	}
+
+	if _, err := introductionsColl.InsertOne(context.Background(), introduction); err != nil {
+		return Introduction{}, err
+	}
+
+	return introduction, nil
+}
+
+// GetIntroductions returns the pending, unexpired introductions involving the user.
+// Nodes poll this to learn that another node wants to connect to them.
+func GetIntroductions(username string) ([]Introduction, error) {
+	filter := bson.D{
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "from", Value: username}},
+			bson.D{{Key: "to", Value: username}},
+		}},
+		{Key: "status", Value: RENDEZVOUS_PENDING},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now().Unix()}}},
+	}
+
+	cursor, err := introductionsColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	introductions := []Introduction{}
+	if err := cursor.All(context.Background(), &introductions); err != nil {
+		return nil, err
+	}
+
+	return introductions, nil
+}
+
+// ReportIntroduction records whether a node managed to connect in the introduction's
+// current stage. A failed direct connection moves the introduction to the relay stage,
+// using the relay the target node is attached to; a failed relay connection fails it.
+func ReportIntroduction(id string, username string, success bool) (Introduction, error) {
+	introduction, err := getIntroduction(id)
+	if err != nil {
+		return Introduction{}, err
+	}
+
+	if username != introduction.From && username != introduction.To {
+		return Introduction{}, fmt.Errorf("user is not part of this introduction")
+	}
+	if introduction.Status != RENDEZVOUS_PENDING {
+		return Introduction{}, fmt.Errorf("introduction is already %v", introduction.Status)
+	}
+
+	reportedStage := introduction.Stage
+
+	if time.Now().Unix() > introduction.ExpiresAt {
+		introduction.Status = RENDEZVOUS_FAILED
+	} else if success {
+		introduction.Status = RENDEZVOUS_CONNECTED
+	} else if introduction.Stage == RENDEZVOUS_STAGE_DIRECT {
+		relay, err := introductionRelay(introduction)
+		if err != nil {
+			introduction.Status = RENDEZVOUS_FAILED
+		} else {
+			introduction.Stage = RENDEZVOUS_STAGE_RELAY
+			introduction.Relay = relay
+			introduction.ExpiresAt = time.Now().Add(RENDEZVOUS_INTRODUCTION_TTL).Unix()
+		}
+	} else {
+		introduction.Status = RENDEZVOUS_FAILED
+	}
+
+	// Only apply the report if the other node has not moved the introduction on in the meantime
+	filter := bson.D{
+		{Key: "id", Value: id},
+		{Key: "status", Value: RENDEZVOUS_PENDING},
+		{Key: "stage", Value: reportedStage},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "stage", Value: introduction.Stage},
+		{Key: "relay", Value: introduction.Relay},
+		{Key: "status", Value: introduction.Status},
+		{Key: "expires_at", Value: introduction.ExpiresAt},
+	}}}
+	if result, err := introductionsColl.UpdateOne(context.Background(), filter, update); err != nil {
+		return Introduction{}, err
+	} else if result.MatchedCount == 0 {
+		// Return the introduction as the other node left it
+		return getIntroduction(id)
+	}
+
+	return introduction, nil
+}
+
+// getIntroduction returns the introduction with the given ID.
+func getIntroduction(id string) (Introduction, error) {
+	var introduction Introduction
+	if err := introductionsColl.FindOne(context.Background(), bson.D{{Key: "id", Value: id}}).Decode(&introduction); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Introduction{}, fmt.Errorf("introduction not found")
+		}
+		return Introduction{}, err
+	}
+
+	return introduction, nil
+}
+
+// introductionRelay returns the relay both nodes should connect through: the one the target
+// is attached to, or else the requester's, or else an assigned one.
+func introductionRelay(introduction Introduction) (string, error) {
+	for _, username := range []string{introduction.To, introduction.From} {
+		var host Host
+		if err := hostsColl.FindOne(context.Background(), bson.D{{Key: "user_name", Value: username}}).Decode(&host); err == nil && host.RelayAddress != "" {
+			return host.RelayAddress, nil
+		}
+	}
+
+	if relay := assignRelay(introduction.To); relay != "" {
+		return relay, nil
+	}
+
+	return "", fmt.Errorf("no relay available")
+}
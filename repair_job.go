@@ -0,0 +1,21 @@
+package main
+
+// RepairJob asks a surviving holder of a shard (the source) to copy it to a replacement
+// host (the target) because one of the shard's holders is dead. If no holder of the shard
+// survives, Reconstruct is set and the source rebuilds the shard from the file's other
+// shards instead.
+type RepairJob struct {
+	ID          string  `bson:"id" json:"id"`
+	FileID      string  `bson:"file_id" json:"file_id"`
+	FileName    string  `bson:"file_name" json:"file_name"`
+	ShardIndex  int     `bson:"shard_index" json:"shard_index"`
+	DeadHost    string  `bson:"dead_host" json:"dead_host"`
+	SourceHost  string  `bson:"source_host" json:"source_host"`
+	TargetHost  string  `bson:"target_host" json:"target_host"`
+	Reconstruct bool    `bson:"reconstruct" json:"reconstruct"`
+	ShardSize   float64 `bson:"shard_size" json:"shard_size"` // in gigabytes
+	Reason      string  `bson:"reason" json:"reason"`
+	Status      string  `bson:"status" json:"status"`
+	CreatedAt   int64   `bson:"created_at" json:"created_at"` // in unix time
+	UpdatedAt   int64   `bson:"updated_at" json:"updated_at"` // in unix time
+}
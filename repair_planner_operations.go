@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunRepairPlanner plans repairs for the files held by dead hosts every interval. It
+// blocks and is meant to be run in its own goroutine.
+func RunRepairPlanner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if planned, err := PlanRepairs(); err != nil {
+			log.Println("Unable to plan repairs:", err)
+		} else if planned > 0 {
+			log.Printf("Planned %v shard repairs\n", planned)
+		}
+		<-ticker.C
+	}
+}
+
+// PlanRepairs finds the storage pool files that have a shard on a host that has been dead
+// for longer than REPAIR_DEAD_THRESHOLD, and plans a repair for each of those shards. It
+// returns the number of repair jobs created.
+func PlanRepairs() (int, error) {
+	if err := failTimedOutRepairJobs(); err != nil {
+		return 0, err
+	}
+
+	deadSince := time.Now().Add(-REPAIR_DEAD_THRESHOLD).Unix()
+	cursor, err := hostsColl.Find(context.Background(), bson.D{{Key: "last_heartbeat", Value: bson.D{{Key: "$lt", Value: deadSince}}}})
+	if err != nil {
+		return 0, err
+	}
+
+	var deadHosts []Host
+	if err := cursor.All(context.Background(), &deadHosts); err != nil {
+		return 0, err
+	}
+	if len(deadHosts) == 0 {
+		return 0, nil
+	}
+
+	dead := make(map[string]bool)
+	deadAddresses := bson.A{}
+	for _, host := range deadHosts {
+		dead[host.Address] = true
+		deadAddresses = append(deadAddresses, host.Address)
+	}
+
+	filter := bson.D{
+		{Key: "in_storage_pool", Value: true},
+		{Key: "hosts", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$in", Value: deadAddresses}}}}}}},
+	}
+	cursor, err = uploadedFilesColl.Find(context.Background(), filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, err
+	}
+
+	planned := 0
+	for _, file := range files {
+		for shardIndex, shardHosts := range file.Hosts {
+			for _, address := range shardHosts {
+				if !dead[address] {
+					continue
+				}
+
+				job, created, err := PlanShardRepair(file, shardIndex, address, "host dead")
+				if err != nil {
+					log.Printf("Unable to plan repair of shard %v of %v: %v\n", shardIndex, file.FileName, err)
+					continue
+				}
+				if created {
+					log.Printf("Planned repair %v: shard %v of %v from %v to %v\n", job.ID, shardIndex, file.FileName, job.SourceHost, job.TargetHost)
+					planned++
+				}
+			}
+		}
+	}
+
+	return planned, nil
+}
+
+// PlanShardRepair creates a repair job replacing badHost as a holder of the file's shard. If
+// a repair of that shard and host is already in progress, that job is returned instead and
+// created is false.
+func PlanShardRepair(file UploadedFile, shardIndex int, badHost string, reason string) (job RepairJob, created bool, err error) {
+	if shardIndex < 0 || shardIndex >= len(file.Hosts) {
+		return RepairJob{}, false, fmt.Errorf("invalid shard index %v", shardIndex)
+	}
+
+	existingFilter := bson.D{
+		{Key: "file_id", Value: file.ID.Hex()},
+		{Key: "shard_index", Value: shardIndex},
+		{Key: "dead_host", Value: badHost},
+		{Key: "status", Value: REPAIR_PENDING},
+	}
+	if err := repairJobsColl.FindOne(context.Background(), existingFilter).Decode(&job); err == nil {
+		return job, false, nil
+	} else if err != mongo.ErrNoDocuments {
+		return RepairJob{}, false, err
+	}
+
+	source, reconstruct, err := selectRepairSource(file, shardIndex, badHost)
+	if err != nil {
+		return RepairJob{}, false, err
+	}
+
+	// Hosts already receiving another shard of the file must not be given a second one
+	exclude, err := pendingRepairTargets(file.ID.Hex())
+	if err != nil {
+		return RepairJob{}, false, err
+	}
+
+	target, err := selectReplacementHost(file, file.ShardSize(), append(exclude, badHost)...)
+	if err != nil {
+		return RepairJob{}, false, err
+	}
+
+	now := time.Now().Unix()
+	job = RepairJob{
+		ID:          primitive.NewObjectID().Hex(),
+		FileID:      file.ID.Hex(),
+		FileName:    file.FileName,
+		ShardIndex:  shardIndex,
+		DeadHost:    badHost,
+		SourceHost:  source,
+		TargetHost:  target.Address,
+		Reconstruct: reconstruct,
+		ShardSize:   file.ShardSize(),
+		Reason:      reason,
+		Status:      REPAIR_PENDING,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if _, err := repairJobsColl.InsertOne(context.Background(), job); err != nil {
+		return RepairJob{}, false, err
+	}
+
+	// Reserve the space on the target until its next heartbeat reports the real figure
+	reserve := bson.D{{Key: "$inc", Value: bson.D{
+		{Key: "free_space", Value: -job.ShardSize},
+		{Key: "repairs_assigned", Value: 1},
+	}}}
+	if _, err := hostsColl.UpdateOne(context.Background(), bson.D{{Key: "address", Value: target.Address}}, reserve); err != nil {
+		log.Println("Unable to reserve space on repair target:", err)
+	}
+	incrementHostCounter(source, "repairs_assigned")
+
+	return job, true, nil
+}
+
+// selectRepairSource picks an online holder of the shard to copy it from. If none is
+// online, it picks an online holder of another shard to reconstruct it, and reconstruct
+// is true.
+func selectRepairSource(file UploadedFile, shardIndex int, badHost string) (source string, reconstruct bool, err error) {
+	online := func(address string) bool {
+		if address == badHost {
+			return false
+		}
+		host, err := GetHostByAddress(address)
+		return err == nil && host.Status == HOST_ONLINE
+	}
+
+	for _, address := range file.Hosts[shardIndex] {
+		if online(address) {
+			return address, false, nil
+		}
+	}
+
+	for i, shardHosts := range file.Hosts {
+		if i == shardIndex {
+			continue
+		}
+		for _, address := range shardHosts {
+			if online(address) {
+				return address, true, nil
+			}
+		}
+	}
+
+	return "", false, fmt.Errorf("no online holder of %v can repair shard %v", file.FileName, shardIndex)
+}
+
+// pendingRepairTargets returns the target hosts of the file's pending repairs.
+func pendingRepairTargets(fileID string) ([]string, error) {
+	filter := bson.D{{Key: "file_id", Value: fileID}, {Key: "status", Value: REPAIR_PENDING}}
+	targets, err := repairJobsColl.Distinct(context.Background(), "target_host", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for _, target := range targets {
+		if address, ok := target.(string); ok {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses, nil
+}
+
+// selectReplacementHost picks the online host that can hold a shard of the given size and
+// does not already hold a shard of the file, favouring reputable hosts with more free space.
+func selectReplacementHost(file UploadedFile, shardSize float64, exclude ...string) (Host, error) {
+	candidates, err := GetHosts(HOST_ONLINE)
+	if err != nil {
+		return Host{}, err
+	}
+
+	excluded := make(map[string]bool)
+	for _, address := range exclude {
+		excluded[address] = true
+	}
+
+	var best *Host
+	for i, host := range candidates {
+		if excluded[host.Address] || host.UserName == file.UploaderUsername || file.HoldsShard(host.Address) || host.FreeSpace < shardSize {
+			continue
+		}
+		if best == nil || host.FreeSpace*reputationWeight(host.Reputation) > best.FreeSpace*reputationWeight(best.Reputation) {
+			best = &candidates[i]
+		}
+	}
+
+	if best == nil {
+		return Host{}, fmt.Errorf("no online host has %.2f GB free for a replacement shard", shardSize)
+	}
+
+	return *best, nil
+}
+
+// GetRepairJobs returns the repair jobs where the given host is the source or the target,
+// optionally restricted to one status. An empty host returns every host's jobs.
+func GetRepairJobs(host string, status string) ([]RepairJob, error) {
+	filter := bson.D{}
+	if host != "" {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "source_host", Value: host}},
+			bson.D{{Key: "target_host", Value: host}},
+		}})
+	}
+	if status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+
+	cursor, err := repairJobsColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []RepairJob{}
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// ConfirmRepairJob records the outcome of a repair reported by its source or target host.
+// When the repair succeeded, the target replaces the dead host in the file's shard hosts.
+func ConfirmRepairJob(id string, host string, success bool) (RepairJob, error) {
+	var job RepairJob
+	if err := repairJobsColl.FindOne(context.Background(), bson.D{{Key: "id", Value: id}}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return RepairJob{}, fmt.Errorf("repair job not found")
+		}
+		return RepairJob{}, err
+	}
+
+	if host != job.SourceHost && host != job.TargetHost {
+		return RepairJob{}, fmt.Errorf("host is not part of this repair job")
+	}
+	if job.Status != REPAIR_PENDING {
+		return RepairJob{}, fmt.Errorf("repair job is already %v", job.Status)
+	}
+
+	job.Status = REPAIR_FAILED
+	if success {
+		if err := replaceShardHost(job); err != nil {
+			return RepairJob{}, err
+		}
+		job.Status = REPAIR_CONFIRMED
+
+		incrementHostCounter(job.SourceHost, "repairs_completed")
+		incrementHostCounter(job.TargetHost, "repairs_completed")
+	}
+	job.UpdatedAt = time.Now().Unix()
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: job.Status},
+		{Key: "updated_at", Value: job.UpdatedAt},
+	}}}
+	if _, err := repairJobsColl.UpdateOne(context.Background(), bson.D{{Key: "id", Value: id}}, update); err != nil {
+		return RepairJob{}, err
+	}
+
+	return job, nil
+}
+
+// replaceShardHost swaps the dead host for the target in the shard's hosts. If the dead host
+// is no longer listed (e.g. it was removed by hand), the target is added alongside the others.
+func replaceShardHost(job RepairJob) error {
+	fileID, err := primitive.ObjectIDFromHex(job.FileID)
+	if err != nil {
+		return err
+	}
+
+	shardField := "hosts." + strconv.Itoa(job.ShardIndex)
+	filter := bson.D{{Key: "_id", Value: fileID}}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: shardField + ".$[dead]", Value: job.TargetHost}}}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.D{{Key: "dead", Value: job.DeadHost}}}})
+
+	result, err := uploadedFilesColl.UpdateOne(context.Background(), filter, update, opts)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("file of repair job no longer exists")
+	}
+
+	if result.ModifiedCount == 0 {
+		update = bson.D{{Key: "$addToSet", Value: bson.D{{Key: shardField, Value: job.TargetHost}}}}
+		if _, err := uploadedFilesColl.UpdateOne(context.Background(), filter, update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// failTimedOutRepairJobs fails the pending repair jobs older than REPAIR_JOB_TIMEOUT so
+// that the next planning round can try another source or target.
+func failTimedOutRepairJobs() error {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "status", Value: REPAIR_PENDING},
+		{Key: "created_at", Value: bson.D{{Key: "$lt", Value: now.Add(-REPAIR_JOB_TIMEOUT).Unix()}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: REPAIR_FAILED},
+		{Key: "updated_at", Value: now.Unix()},
+	}}}
+
+	_, err := repairJobsColl.UpdateMany(context.Background(), filter, update)
+	return err
+}
@@ -0,0 +1,8 @@
+package main
+
+// RetentionRule deletes the files a user records in Folder (or below it) Retention seconds
+// after they are recorded, unless they are given an expiry of their own.
+type RetentionRule struct {
+	Folder    string `bson:"folder" json:"folder"`
+	Retention int64  `bson:"retention" json:"retention"` // in seconds
+}
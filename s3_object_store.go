@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3ObjectStore stores objects in a bucket of AWS S3 or any S3-compatible service. URLs are
+// pre-signed with AWS Signature Version 4 (query string authentication).
+type S3ObjectStore struct {
+	Endpoint        string // e.g. "https://s3.eu-west-2.amazonaws.com"
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PathStyle addresses the bucket in the path (endpoint/bucket/key) rather than the host
+	// (bucket.endpoint/key), as most S3-compatible services expect
+	PathStyle bool
+}
+
+// S3 does not accept pre-signed URLs that are valid for longer than a week
+const s3MaxPresignExpiry = 7 * 24 * time.Hour
+
+func (s *S3ObjectStore) PresignPut(key string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodPut, key, expiry, time.Now())
+}
+
+func (s *S3ObjectStore) PresignGet(key string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, expiry, time.Now())
+}
+
+func (s *S3ObjectStore) Delete(key string) error {
+	signedURL, err := s.presign(http.MethodDelete, key, OBJECT_URL_EXPIRY, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, signedURL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 answers 204 whether or not the object existed
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("deleting object %v failed with status %v", key, resp.Status)
+	}
+
+	return nil
+}
+
+// presign returns the URL for the request, signed at the given time.
+func (s *S3ObjectStore) presign(method string, key string, expiry time.Duration, now time.Time) (string, error) {
+	if expiry <= 0 || expiry > s3MaxPresignExpiry {
+		return "", fmt.Errorf("pre-signed URLs must expire within %v", s3MaxPresignExpiry)
+	}
+
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return "", fmt.Errorf("invalid S3 endpoint [%v]", s.Endpoint)
+	}
+
+	host := endpoint.Host
+	path := "/" + s3EscapePath(key)
+	if s.PathStyle {
+		path = "/" + s.Bucket + path
+	} else {
+		host = s.Bucket + "." + host
+	}
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprint(int64(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return fmt.Sprintf("%v://%v%v?%v&X-Amz-Signature=%v", endpoint.Scheme, host, path, canonicalQuery, signature), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery returns the parameters sorted by name and escaped as SigV4 requires.
+func s3CanonicalQuery(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = s3Escape(name) + "=" + s3Escape(params[name])
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// s3EscapePath escapes every segment of the key, keeping the slashes between them.
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of RFC 3986. Unlike
+// url.QueryEscape, spaces become "%20" rather than "+".
+func s3Escape(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
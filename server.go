@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fatih/structs"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -18,6 +22,23 @@ var client *mongo.Client
 var storageCapacityColl *mongo.Collection
 var uploadedFilesColl *mongo.Collection
 var userDetailsColl *mongo.Collection
+var networkHistoryColl *mongo.Collection
+var alertRulesColl *mongo.Collection
+var activeAlertsColl *mongo.Collection
+var webhooksColl *mongo.Collection
+var webhookDeadLettersColl *mongo.Collection
+var hostsColl *mongo.Collection
+var repairJobsColl *mongo.Collection
+var storageChallengesColl *mongo.Collection
+var creditLedgerColl *mongo.Collection
+var introductionsColl *mongo.Collection
+var corruptionReportsColl *mongo.Collection
+var foldersColl *mongo.Collection
+var shareGrantsColl *mongo.Collection
+var keyEnvelopesColl *mongo.Collection
+var shardPurgesColl *mongo.Collection
+var migrationJobsColl *mongo.Collection
+var dedupChallengesColl *mongo.Collection
 
 var RouteCommands map[string]func(http.ResponseWriter, *http.Request) = make(map[string]func(http.ResponseWriter, *http.Request))
 
@@ -37,6 +58,23 @@ func StartServer() {
 		storageCapacityColl = client.Database(DB_NAME).Collection(STORAGE_CAPACITY_COLL_NAME)
 		uploadedFilesColl = client.Database(DB_NAME).Collection(UPLOADED_FILES_COLL_NAME)
 		userDetailsColl = client.Database(DB_NAME).Collection(USER_DETAILS_COLL_NAME)
+		networkHistoryColl = client.Database(DB_NAME).Collection(NETWORK_HISTORY_COLL_NAME)
+		alertRulesColl = client.Database(DB_NAME).Collection(ALERT_RULES_COLL_NAME)
+		activeAlertsColl = client.Database(DB_NAME).Collection(ACTIVE_ALERTS_COLL_NAME)
+		webhooksColl = client.Database(DB_NAME).Collection(WEBHOOKS_COLL_NAME)
+		webhookDeadLettersColl = client.Database(DB_NAME).Collection(WEBHOOK_DEAD_LETTERS_COLL_NAME)
+		hostsColl = client.Database(DB_NAME).Collection(HOSTS_COLL_NAME)
+		repairJobsColl = client.Database(DB_NAME).Collection(REPAIR_JOBS_COLL_NAME)
+		storageChallengesColl = client.Database(DB_NAME).Collection(STORAGE_CHALLENGES_COLL_NAME)
+		creditLedgerColl = client.Database(DB_NAME).Collection(CREDIT_LEDGER_COLL_NAME)
+		introductionsColl = client.Database(DB_NAME).Collection(INTRODUCTIONS_COLL_NAME)
+		corruptionReportsColl = client.Database(DB_NAME).Collection(CORRUPTION_REPORTS_COLL_NAME)
+		foldersColl = client.Database(DB_NAME).Collection(FOLDERS_COLL_NAME)
+		shareGrantsColl = client.Database(DB_NAME).Collection(SHARE_GRANTS_COLL_NAME)
+		keyEnvelopesColl = client.Database(DB_NAME).Collection(KEY_ENVELOPES_COLL_NAME)
+		shardPurgesColl = client.Database(DB_NAME).Collection(SHARD_PURGES_COLL_NAME)
+		migrationJobsColl = client.Database(DB_NAME).Collection(MIGRATION_JOBS_COLL_NAME)
+		dedupChallengesColl = client.Database(DB_NAME).Collection(DEDUP_CHALLENGES_COLL_NAME)
 
 		defer func() {
 			if err := client.Disconnect(context.TODO()); err != nil {
@@ -45,8 +83,64 @@ func StartServer() {
 		}()
 	}
 
+	// Files recorded before the fields were named must be migrated before anything queries them
+	if err := MigrateLegacyFileFields(); err != nil {
+		panic(err)
+	}
+
+	// Duplicate version numbers and host addresses would keep their unique indexes from being built
+	if err := MigrateDuplicateFileVersions(); err != nil {
+		panic(err)
+	}
+	if err := MigrateDuplicateHostAddresses(); err != nil {
+		panic(err)
+	}
+
+	if err := CreateIndexes(); err != nil {
+		panic(err)
+	}
+
+	// Periodically snapshot the network storage state for /network/history
+	go RunNetworkHistorySnapshots(envDuration("SHR_HISTORY_SNAPSHOT_INTERVAL", NETWORK_HISTORY_SNAPSHOT_INTERVAL))
+
+	// Store the AWS tier through pre-signed URLs if an object store is configured
+	objectStore = ObjectStoreFromEnv()
+
+	// Evaluate the capacity alert rules whenever the network counters change, carrying on
+	// from the alerts that were firing before the restart
+	alerts.SetNotifiers(AlertNotifiersFromEnv())
+	if err := alerts.Load(); err != nil {
+		log.Println("Unable to load the active alerts:", err)
+	}
+	go RunAlertEvaluator()
+	TriggerNetworkAlertEvaluation()
+
+	// Plan repairs for the shards held by hosts that have gone offline
+	go RunRepairPlanner(envDuration("SHR_REPAIR_PLAN_INTERVAL", REPAIR_PLAN_INTERVAL))
+
+	// Challenge hosts to prove they still hold the shards they were given
+	go RunChallengeIssuer(envDuration("SHR_CHALLENGE_INTERVAL", CHALLENGE_INTERVAL))
+
+	// Keep the host reputations used for placement up to date
+	go RunReputationUpdater(REPUTATION_UPDATE_INTERVAL)
+
+	// Credit monthly subscribers for the shards they host for others
+	go RunCreditAccrual(CREDITS_SETTLEMENT_INTERVAL)
+
+	// Delete files once they expire
+	go RunExpirySweeper(envDuration("SHR_EXPIRY_SWEEP_INTERVAL", EXPIRY_SWEEP_INTERVAL))
+
+	// Delete trashed files for good once they can no longer be restored
+	go RunTrashPurger(TRASH_PURGE_INTERVAL)
+
+	// Move files between the storage pool and AWS as the pool fills up and frees up
+	go RunMigrationPlanner(envDuration("SHR_MIGRATION_PLAN_INTERVAL", MIGRATION_PLAN_INTERVAL))
+
 	println("Server started on port", PORT)
 
+	// Requests are not authenticated apart from the admin token checked by requireAdmin, so
+	// user_name and requester are whoever the caller says they are. Handlers that only show
+	// some details to some users keep them out of casual listings; that is not access control.
 	CreateCommandAction("/init", initialiseStorageStateHandler)
 
 	// Routes for getting the total AWS and storage pool size
@@ -64,6 +158,27 @@ func StartServer() {
 	// Route to record the uploaded file
 	CreateCommandAction("/file", recordFileHandler)
 
+	// Route for estimating how likely a storage pool file is to be retrievable at each hour
+	CreateCommandAction("/file/availability", getFileAvailabilityHandler)
+	CreateCommandAction("/file/corruption", fileCorruptionHandler)
+	CreateCommandAction("/file/versions", getFileVersionsHandler)
+	CreateCommandAction("/file/move", moveFileHandler)
+	CreateCommandAction("/file/expiry", setFileExpiryHandler)
+	CreateCommandAction("/retention", manageRetentionRulesHandler)
+	CreateCommandAction("/purges", getShardPurgesHandler)
+	CreateCommandAction("/purges/confirm", confirmShardPurgeHandler)
+	CreateCommandAction("/trash", getTrashHandler)
+	CreateCommandAction("/trash/restore", restoreFromTrashHandler)
+	CreateCommandAction("/migrations", manageMigrationsHandler)
+	CreateCommandAction("/migrations/complete", completeMigrationHandler)
+	CreateCommandAction("/objects/", objectsHandler)
+	CreateCommandAction("/folders", manageFoldersHandler)
+	CreateCommandAction("/folders/move", moveFolderHandler)
+	CreateCommandAction("/shares", manageSharesHandler)
+	CreateCommandAction("/shares/with-me", getSharedWithMeHandler)
+	CreateCommandAction("/keys/public", managePublicKeyHandler)
+	CreateCommandAction("/keys/envelopes", manageKeyEnvelopesHandler)
+
 	// Route to increment the total AWS and storage pool size
 	CreateCommandAction("/inc/aws", incrementAwsStorageSizeHandler)
 	CreateCommandAction("/inc/spool", incrementStoragePoolSizeHandler)
@@ -73,6 +188,51 @@ func StartServer() {
 
 	CreateCommandAction("/users", getUsersHandler)
 
+	// Route for getting a user's credit balance and ledger
+	CreateCommandAction("/credits", getCreditsHandler)
+
+	// Route for getting the whole network storage state in a single read
+	CreateCommandAction("/network", getNetworkOverviewHandler)
+
+	// Route for getting the downsampled history of the network storage state
+	CreateCommandAction("/network/history", getNetworkHistoryHandler)
+
+	// Route for forecasting when the storage pool and AWS storage will be exhausted
+	CreateCommandAction("/network/forecast", getNetworkForecastHandler)
+
+	// Route for streaming network storage state changes (server-sent events)
+	CreateCommandAction("/network/events", networkStateEventsHandler)
+
+	// Routes for listing the active alerts and managing the alert rules
+	CreateCommandAction("/alerts", getAlertsHandler)
+	CreateCommandAction("/alerts/rules", manageAlertRulesHandler)
+
+	// Routes for managing webhook subscriptions and undeliverable webhook events (admin)
+	CreateCommandAction("/webhooks", manageWebhooksHandler)
+	CreateCommandAction("/webhooks/dead-letters", manageWebhookDeadLettersHandler)
+
+	// Routes for node heartbeats and listing the registered hosts
+	CreateCommandAction("/hosts", getHostsHandler)
+	CreateCommandAction("/hosts/heartbeat", hostHeartbeatHandler)
+	CreateCommandAction("/reputation", getReputationHandler)
+
+	// Route for finding distinct random peers to exchange shards with
+	CreateCommandAction("/peers", getPeersHandler)
+
+	// Routes for hosts to fetch their repair jobs and report their outcome
+	CreateCommandAction("/repairs", getRepairJobsHandler)
+	CreateCommandAction("/repairs/confirm", confirmRepairJobHandler)
+
+	// Routes for hosts to fetch and answer their proof-of-storage challenges
+	CreateCommandAction("/challenges", getStorageChallengesHandler)
+	CreateCommandAction("/challenges/respond", respondToStorageChallengeHandler)
+
+	// Routes for brokering connections between nodes behind NAT
+	CreateCommandAction("/rendezvous/register", registerEndpointsHandler)
+	CreateCommandAction("/rendezvous/introduce", requestIntroductionHandler)
+	CreateCommandAction("/rendezvous/introductions", getIntroductionsHandler)
+	CreateCommandAction("/rendezvous/report", reportIntroductionHandler)
+
 	for path, action := range RouteCommands {
 		http.HandleFunc(path, action)
 	}
@@ -98,8 +258,16 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		amountInt, _ := strconv.Atoi(amount)
+		if amountInt <= 0 {
+			SendResponse(w, false, "amount must be positive", nil)
+			return
+		}
+		if amountInt > PEER_DISCOVERY_MAX_AMOUNT {
+			SendResponse(w, false, fmt.Sprintf("amount cannot be more than %v", PEER_DISCOVERY_MAX_AMOUNT), nil)
+			return
+		}
 
-		if users, err := GetUsers(amountInt); err != nil {
+		if users, err := GetUsers(amountInt, queryParams.Get("exclude")); err != nil {
 			SendResponse(w, false, err.Error(), nil)
 		} else {
 			if len(users) == 0 {
@@ -112,6 +280,36 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getCreditsHandler returns the credit balance and recent credit ledger entries of the
+// user given in the user_name query parameter
+func getCreditsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	username := r.URL.Query().Get("user_name")
+	if username == "" {
+		SendResponse(w, false, "user_name query parameter not provided", nil)
+		return
+	}
+
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	if ledger, err := GetCreditLedger(username, CREDITS_LEDGER_ENTRIES_SHOWN); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Credits", map[string]interface{}{
+			"balance": user.Credits,
+			"ledger":  ledger,
+		})
+	}
+}
+
 // manageUserHandler manages the users
 func manageUserHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -164,11 +362,20 @@ func manageUserHandler(w http.ResponseWriter, r *http.Request) {
 			value = int64(value.(int))
 		}
 
-		if fieldName == "num_files_uploaded" {
+		if fieldName == "number_of_files" {
 			value, _ = strconv.Atoi(fieldValue)
 			value = int(value.(int))
 		}
 
+		if fieldName == "versions_kept" {
+			versionsKept, err := strconv.Atoi(fieldValue)
+			if err != nil || versionsKept < 0 || versionsKept > FILE_VERSIONS_MAX {
+				SendResponse(w, false, fmt.Sprintf("versions_kept must be between 0 (the default) and %v", FILE_VERSIONS_MAX), nil)
+				return
+			}
+			value = versionsKept
+		}
+
 		if ok, err := UpdateUser(fieldName, value, username); err != nil {
 			SendResponse(w, false, err.Error(), nil)
 		} else {
@@ -296,9 +503,68 @@ func incrementStoragePoolSizeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // recordFileHandler is called after a file has been uploaded. It records the file
-// in the database.
+// in the database. If a content_hash is given, a file with the same content and shard
+// layout is already stored and the node answers the dedup_challenge from /store with
+// dedup_proofs, the file is recorded as a reference to it.
+//
+// The file may come with integrity metadata (file_hash, shard_hashes and erasure_coding)
+// which a GET request returns along with the file's hosts.
+//
+// Files are identified by their uploader, folder (the root folder if not given) and name.
+// Recording a file name the user already has in the folder creates a new version of the
+// file. A GET request returns the latest version unless a version is given; its hosts and
+// shard metadata are only included for the uploader and users the file is shared with
+// (user_name), or for a share link (token, which identifies the file on its own).
+//
+// A DELETE request moves every version of the file to the trash, or removes them straight
+// away if permanent=true. A single version can only be removed for good, since the trash
+// restores whole files, so deleting a version requires permanent=true.
 func recordFileHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case "GET":
+		fileName := r.URL.Query().Get("file_name")
+		uploaderUsername := r.URL.Query().Get("uploader_username")
+		folder := r.URL.Query().Get("folder")
+		requester := r.URL.Query().Get("user_name")
+		token := r.URL.Query().Get("token")
+
+		if token != "" {
+			grant, err := GetShareGrantByToken(token)
+			if err != nil {
+				SendResponse(w, false, err.Error(), nil)
+				return
+			}
+			fileName, uploaderUsername, folder = grant.FileName, grant.Owner, grant.Folder
+		}
+
+		if fileName == "" || uploaderUsername == "" {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
+
+		var file UploadedFile
+		var err error
+		if version := r.URL.Query().Get("version"); version != "" {
+			versionInt, convErr := strconv.Atoi(version)
+			if convErr != nil {
+				SendResponse(w, false, "Invalid version", nil)
+				return
+			}
+			file, err = GetFileVersion(uploaderUsername, folder, fileName, versionInt)
+		} else {
+			file, err = GetUploadedFile(uploaderUsername, folder, fileName)
+		}
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		if file, err = FileForRequester(file, requester, token); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "File", file)
+		}
+
 	case "POST":
 		r.ParseForm()
 
@@ -309,28 +575,37 @@ func recordFileHandler(w http.ResponseWriter, r *http.Request) {
 		hosts := r.FormValue("hosts")
 		shards := r.FormValue("shards")
 		uploaderUsername := r.FormValue("uploader_username")
+		folder := r.FormValue("folder")
 		backupShards := r.FormValue("backup_shards")
 		isMonthlySub := r.FormValue("is_monthly_sub")
 		timezone := r.FormValue("timezone")
+		contentHash := r.FormValue("content_hash")
 
-		if fileName == "" || uploadDate == 0 || inStoragePool == "" || hosts == "" || uploaderUsername == "" || isMonthlySub == "" || timezone == "" {
+		// Hosts can only be left out when the content is already stored (see below)
+		if fileName == "" || uploadDate == 0 || inStoragePool == "" || (hosts == "" && contentHash == "") || uploaderUsername == "" || isMonthlySub == "" || timezone == "" {
 			SendResponse(w, false, "Invalid parameters", nil)
 			return
 		}
 
+		// The folder is given separately, the name cannot contain one
+		if strings.Contains(fileName, "/") {
+			SendResponse(w, false, "file_name cannot contain /", nil)
+			return
+		}
+
 		// Check if the user exists
 		if _, err := GetUserByUsername(uploaderUsername); err != nil {
 			SendResponse(w, false, err.Error(), nil)
-			panic(err)
 			return
 		}
 
 		// Convert the hosts string to a 2D string array
 		var hosts2D [][]string
-		if err := json.Unmarshal([]byte(hosts), &hosts2D); err != nil {
-			SendResponse(w, false, err.Error(), nil)
-			panic(err)
-			return
+		if hosts != "" {
+			if err := json.Unmarshal([]byte(hosts), &hosts2D); err != nil {
+				SendResponse(w, false, "Invalid hosts", nil)
+				return
+			}
 		}
 
 		// Convert the inStoragePool string to a boolean
@@ -365,8 +640,74 @@ func recordFileHandler(w http.ResponseWriter, r *http.Request) {
 			isMonthlySubBool = false
 		}
 
+		// The optional Merkle roots and chunk counts of the shards, used for storage challenges
+		var shardMerkleRoots []string
+		var shardLeafCounts []int
+		if r.FormValue("shard_merkle_roots") != "" || r.FormValue("shard_leaf_counts") != "" {
+			if err := json.Unmarshal([]byte(r.FormValue("shard_merkle_roots")), &shardMerkleRoots); err != nil {
+				SendResponse(w, false, "Invalid shard_merkle_roots", nil)
+				return
+			}
+			if err := json.Unmarshal([]byte(r.FormValue("shard_leaf_counts")), &shardLeafCounts); err != nil {
+				SendResponse(w, false, "Invalid shard_leaf_counts", nil)
+				return
+			}
+			if len(shardMerkleRoots) != len(hosts2D) || len(shardLeafCounts) != len(hosts2D) {
+				SendResponse(w, false, "A Merkle root and chunk count is needed for every shard", nil)
+				return
+			}
+
+			var err error
+			if shardMerkleRoots, err = normaliseMerkleRoots(shardMerkleRoots, shardLeafCounts); err != nil {
+				SendResponse(w, false, err.Error(), nil)
+				return
+			}
+		}
+
+		// The optional integrity metadata: the hash of the whole file, the hash of each
+		// shard and how the file was erasure coded into shards
+		var shardHashes []string
+		if r.FormValue("shard_hashes") != "" {
+			if err := json.Unmarshal([]byte(r.FormValue("shard_hashes")), &shardHashes); err != nil {
+				SendResponse(w, false, "Invalid shard_hashes", nil)
+				return
+			}
+		}
+
+		var erasureCoding *ErasureCoding
+		if r.FormValue("erasure_coding") != "" {
+			if err := json.Unmarshal([]byte(r.FormValue("erasure_coding")), &erasureCoding); err != nil {
+				SendResponse(w, false, "Invalid erasure_coding", nil)
+				return
+			}
+		}
+
+		// The file expires when asked to (expires_at or expires_in seconds), otherwise when
+		// the user's retention rules say
+		var expiresAt int64
+		if r.FormValue("expires_at") != "" || r.FormValue("expires_in") != "" {
+			var err error
+			if r.FormValue("expires_at") != "" {
+				expiresAt, err = strconv.ParseInt(r.FormValue("expires_at"), 10, 64)
+			} else {
+				expiresAt, err = strconv.ParseInt(r.FormValue("expires_in"), 10, 64)
+				expiresAt += time.Now().Unix()
+			}
+			if err != nil || expiresAt <= time.Now().Unix() {
+				SendResponse(w, false, "Invalid expiry", nil)
+				return
+			}
+		} else {
+			var err error
+			if expiresAt, err = DefaultFileExpiry(uploaderUsername, folder, time.Now().Unix()); err != nil {
+				SendResponse(w, false, err.Error(), nil)
+				return
+			}
+		}
+
 		uploadedFile := UploadedFile{
 			FileName:         fileName,
+			Folder:           CleanFolderPath(folder),
 			FileSize:         float64(fileSize),
 			UploadDate:       uploadDate,
 			InStoragePool:    inStoragePoolBool,
@@ -376,12 +717,91 @@ func recordFileHandler(w http.ResponseWriter, r *http.Request) {
 			BackupShards:     backupShardsInt,
 			IsMonthlySub:     isMonthlySubBool,
 			Timezone:         timezone,
+			ShardMerkleRoots: shardMerkleRoots,
+			ShardLeafCounts:  shardLeafCounts,
+			ContentHash:      contentHash,
+			FileHash:         r.FormValue("file_hash"),
+			ShardHashes:      shardHashes,
+			ErasureCoding:    erasureCoding,
+			ExpiresAt:        expiresAt,
+			ObjectKey:        r.FormValue("object_key"),
+		}
+
+		if uploadedFile.ObjectKey != "" && (inStoragePoolBool || !isObjectKeyOf(uploadedFile.ObjectKey, uploaderUsername)) {
+			SendResponse(w, false, "Invalid object_key", nil)
+			return
+		}
+
+		if err := EnsureFolder(uploaderUsername, uploadedFile.Folder); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		// Identical content that is already stored is recorded as a reference to it, once the
+		// uploader has proven they hold it by answering the challenge from /store
+		if contentHash != "" {
+			primary, found, err := FindContentPrimary(contentHash, shardsInt, backupShardsInt)
+			if err != nil {
+				SendResponse(w, false, err.Error(), nil)
+				return
+			}
+
+			if found && r.FormValue("dedup_challenge") != "" {
+				var proofs []LeafProof
+				if err := json.Unmarshal([]byte(r.FormValue("dedup_proofs")), &proofs); err != nil {
+					SendResponse(w, false, "Invalid dedup_proofs", nil)
+					return
+				}
+
+				proven, err := ProveContentPossession(r.FormValue("dedup_challenge"), uploaderUsername, primary, proofs)
+				if err != nil {
+					SendResponse(w, false, err.Error(), nil)
+					return
+				}
+
+				if proven {
+					insertReference := func(file UploadedFile) error { return InsertFileReference(file, primary) }
+					if err := insertFileVersion(&uploadedFile, insertReference); err != nil {
+						SendResponse(w, false, err.Error(), nil)
+						return
+					}
+					// The content is stored already, so the object the node uploaded is not needed
+					deleteStoredObject(uploadedFile.ObjectKey)
+					if err := retireFileVersions(uploadedFile); err != nil {
+						log.Println("Unable to retire earlier file versions:", err)
+					}
+					SendResponse(w, true, "File upload success (deduplicated)", nil)
+					return
+				}
+			}
+
+			// Without proof the file is stored on its own, as if its content were new
+			if found {
+				uploadedFile.ContentHash = ""
+			}
+
+			if hosts == "" && uploadedFile.ObjectKey == "" {
+				SendResponse(w, false, "Content is not proven to be stored, it must be uploaded", nil)
+				return
+			}
+			if uploadedFile.ContentHash != "" {
+				uploadedFile.RefCount = 1
+			}
+		}
+
+		if err := validateIntegrityMetadata(uploadedFile); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
 		}
 
 		// Increment the storage pool used
-		if err := InsertUploadedFile(uploadedFile); err != nil {
+		if err := insertFileVersion(&uploadedFile, InsertUploadedFile); err != nil {
 			SendResponse(w, false, err.Error(), nil)
 		} else {
+			if err := retireFileVersions(uploadedFile); err != nil {
+				log.Println("Unable to retire earlier file versions:", err)
+			}
+
 			var fieldToUpdate string
 			var successMsg string
 			var failMsg string
@@ -405,208 +825,1765 @@ func recordFileHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-	}
-
-}
-
-// storeFileHandler is called before a file is to be uploaded. It tells the node
-// where to store the file and if they can store it.
-//
-// If the user is a monthly subscriber, then they should be told to store their file
-// in AWS except in situations where the storage pool can satisfy all the Fixed Amount
-// customers, in that case their file would be stored in the storage pool.
-// If the user is a Fixed Amount customer, then they should be told to store their file
-// in the storage pool except in situations where the storage pool is full, in that case
-// their file would be stored in AWS.
-func storeFileHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
 
-	if r.FormValue("file_size_gb") == "" {
-		SendResponse(w, false, "file_size_gb form key not specified", nil)
-		return
-	}
+	case "DELETE":
+		r.ParseForm()
 
-	if r.FormValue("account_type") == "" {
-		SendResponse(w, false, "account_type form key not specified", nil)
-		return
-	}
+		fileName := r.FormValue("file_name")
+		uploaderUsername := r.FormValue("uploader_username")
+		folder := r.FormValue("folder")
 
-	fileSizeGB, _ := strconv.Atoi(r.FormValue("file_size_gb"))
-	accountType := r.FormValue("account_type")
+		if fileName == "" || uploaderUsername == "" {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
 
-	totalStoragePoolSize, err := GetTotalStoragePoolSize()
-	if err != nil {
-		SendResponse(w, false, err.Error(), nil)
-	}
+		// Without a version the file is moved to the trash, or deleted for good if asked to
+		if r.FormValue("version") == "" {
+			if r.FormValue("permanent") == "true" {
+				if err := RemoveAllFileVersions(uploaderUsername, folder, fileName); err != nil {
+					SendResponse(w, false, err.Error(), nil)
+				} else {
+					SendResponse(w, true, "File deleted", nil)
+				}
+				return
+			}
 
-	if accountType == "monthly" {
-		// Check if the storage pool can satisfy the file
-		numberOfFixedAmounts1, err := GetNumberOfFixedAmount1Subs()
-		if err != nil {
-			SendResponse(w, false, err.Error(), nil)
+			if err := TrashFile(uploaderUsername, folder, fileName); err != nil {
+				SendResponse(w, false, err.Error(), nil)
+			} else {
+				SendResponse(w, true, "File moved to the trash", nil)
+			}
+			return
 		}
 
-		numberOfFixedAmounts2, err := GetNumberOfFixedAmount2Subs()
+		version, err := strconv.Atoi(r.FormValue("version"))
 		if err != nil {
-			SendResponse(w, false, err.Error(), nil)
-		}
-
-		if float64(numberOfFixedAmounts1*1000) >= totalStoragePoolSize+float64(fileSizeGB) {
-			// Storage pool cannot satisfy the file
-			SendResponse(w, true, "location", "aws")
-		} else if float64(numberOfFixedAmounts2*2000) >= totalStoragePoolSize+float64(fileSizeGB) {
-			// Storage pool cannot satisfy the file
-			SendResponse(w, true, "location", "aws")
-		} else {
-			// Storage pool can satisfy the file
-			SendResponse(w, true, "location", "spool")
-		}
-	} else if accountType == "fixed1" {
-		// Check if the storage pool can satisfy the file
-		if float64(fileSizeGB) < totalStoragePoolSize {
-			// Storage pool can satisfy the file
-			SendResponse(w, true, "location", "spool")
-		} else {
-			// Storage pool cannot satisfy the file
-			SendResponse(w, true, "location", "aws")
+			SendResponse(w, false, "Invalid version", nil)
+			return
 		}
-	} else if accountType == "fixed2" {
-		// Check if the storage pool can satisfy the file
-		if float64(fileSizeGB) < totalStoragePoolSize {
-			// Storage pool can satisfy the file
-			SendResponse(w, true, "location", "spool")
-		} else {
-			// Storage pool cannot satisfy the file
-			SendResponse(w, true, "location", "aws")
+		if r.FormValue("permanent") != "true" {
+			SendResponse(w, false, "Deleting a version is permanent, permanent=true must be given", nil)
+			return
 		}
-	} else {
-		SendResponse(w, false, fmt.Sprintf("Invalid account type [%v]", accountType), nil)
-	}
-}
 
-// getStoragePoolUsedHandler handles sending the total storage pool used when a GET request is made
-// and handles incrementing the total storage pool used when a POST request is made
-func getStoragePoolUsedHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET": // Get storage pool used
-		storagePoolUsed, err := GetStoragePoolUsed()
+		file, err := GetFileVersion(uploaderUsername, folder, fileName, version)
 		if err != nil {
 			SendResponse(w, false, err.Error(), nil)
-		} else {
-			SendResponse(w, true, "Total storage pool used", storagePoolUsed)
+			return
 		}
 
-	case "POST": // Increment storage pool used
-		r.ParseForm()
-		size, _ := strconv.Atoi(r.FormValue("size"))
-
-		// Ensure that the storage pool is not full
-		if ok, err := updateStoragePoolUsed(float64(size)); err != nil {
+		if err := RemoveFileVersion(file); err != nil {
 			SendResponse(w, false, err.Error(), nil)
 		} else {
-			if ok {
-				SendResponse(w, true, "Storage pool used incremented", nil)
-			} else {
-				SendResponse(w, false, "Storage pool is full", nil)
-			}
+			SendResponse(w, true, "File version deleted", nil)
 		}
 	}
+
 }
 
-func updateStoragePoolUsed(fileSize float64) (bool, error) {
-	// Update the storage pool used
-	storagePoolAvailable, err := GetTotalStoragePoolSize()
-	if err != nil {
-		return false, err
+// getFileAvailabilityHandler returns the estimated availability of the file given in the
+// file_name, uploader_username and folder query parameters (the latest version unless a
+// version is given), based on the uptime history of the hosts holding its shards
+func getFileAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
 	}
 
-	totalStoragePoolUsed, err := GetStoragePoolUsed()
+	fileName := r.URL.Query().Get("file_name")
+	uploaderUsername := r.URL.Query().Get("uploader_username")
+	folder := r.URL.Query().Get("folder")
+
+	if fileName == "" || uploaderUsername == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	var file UploadedFile
+	var err error
+	if version := r.URL.Query().Get("version"); version != "" {
+		versionInt, convErr := strconv.Atoi(version)
+		if convErr != nil {
+			SendResponse(w, false, "Invalid version", nil)
+			return
+		}
+		file, err = GetFileVersion(uploaderUsername, folder, fileName, versionInt)
+	} else {
+		file, err = GetUploadedFile(uploaderUsername, folder, fileName)
+	}
 	if err != nil {
-		return false, err
+		SendResponse(w, false, err.Error(), nil)
+		return
 	}
 
-	if storagePoolAvailable-totalStoragePoolUsed <= float64(fileSize) {
-		fmt.Println("Storage pool is full")
-		return false, nil
+	if !file.InStoragePool {
+		SendResponse(w, false, "File is not stored in the storage pool", nil)
+		return
 	}
 
-	// Increment the storage pool used
-	if ok, err := IncrementStoragePoolUsed(float64(fileSize)); err != nil {
-		return false, err
+	if file, err = ResolveFileContent(file); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	if availability, err := GetFileAvailability(file.Hosts, file.Shards); err != nil {
+		SendResponse(w, false, err.Error(), nil)
 	} else {
-		if !ok {
-			return false, fmt.Errorf("failed to increment storage pool used")
+		SendResponse(w, true, "File availability", availability)
+	}
+}
+
+// getFileVersionsHandler returns every retained version of the file given in the
+// file_name and uploader_username query parameters, newest first. As with /file, hosts and
+// shard metadata are only included for requesters (user_name or token) who may read the file
+func getFileVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	fileName := r.URL.Query().Get("file_name")
+	uploaderUsername := r.URL.Query().Get("uploader_username")
+	folder := r.URL.Query().Get("folder")
+
+	if fileName == "" || uploaderUsername == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	versions, err := GetFileVersions(uploaderUsername, folder, fileName)
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	for i := range versions {
+		if versions[i], err = FileForRequester(versions[i], r.URL.Query().Get("user_name"), r.URL.Query().Get("token")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
 		}
 	}
 
-	return true, nil
+	SendResponse(w, true, "File versions", versions)
 }
 
-func updateAWSstorageUsed(fileSize float64) (bool, error) {
-	// Update the AWS storage used
-	awsStorageAvailable, err := GetTotalAwsStorageSize()
-	if err != nil {
-		return false, err
+// moveFileHandler moves every version of a file to new_folder and/or renames it to new_name
+func moveFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
 	}
+	r.ParseForm()
 
-	totalAwsStorageUsed, err := GetTotalAwsStorageUsed()
-	if err != nil {
-		return false, err
+	fileName := r.FormValue("file_name")
+	uploaderUsername := r.FormValue("uploader_username")
+	folder := r.FormValue("folder")
+	newFolder := r.FormValue("new_folder")
+	newName := r.FormValue("new_name")
+
+	if fileName == "" || uploaderUsername == "" || (newFolder == "" && newName == "") {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
 	}
 
-	if awsStorageAvailable-totalAwsStorageUsed <= float64(fileSize) {
-		fmt.Println("AWS storage is full")
-		return false, nil
+	if newFolder == "" {
+		newFolder = folder
+	}
+	if newName == "" {
+		newName = fileName
 	}
 
-	// Increment the AWS storage used
-	if ok, err := IncrementAwsStorageUsed(float64(fileSize)); err != nil {
-		return false, err
+	if err := MoveFile(uploaderUsername, folder, fileName, newFolder, newName); err != nil {
+		SendResponse(w, false, err.Error(), nil)
 	} else {
-		if !ok {
-			return false, fmt.Errorf("failed to increment AWS storage used")
+		SendResponse(w, true, "File moved", nil)
+	}
+}
+
+// setFileExpiryHandler sets when every version of a file expires, as expires_at (unix
+// time) or expires_in seconds from now; an expires_at of 0 keeps the file indefinitely
+func setFileExpiryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	fileName := r.FormValue("file_name")
+	uploaderUsername := r.FormValue("uploader_username")
+	folder := r.FormValue("folder")
+
+	if fileName == "" || uploaderUsername == "" || (r.FormValue("expires_at") == "" && r.FormValue("expires_in") == "") {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	var expiresAt int64
+	var err error
+	if r.FormValue("expires_at") != "" {
+		expiresAt, err = strconv.ParseInt(r.FormValue("expires_at"), 10, 64)
+	} else {
+		expiresAt, err = strconv.ParseInt(r.FormValue("expires_in"), 10, 64)
+		expiresAt += time.Now().Unix()
+	}
+	if err != nil {
+		SendResponse(w, false, "Invalid expiry", nil)
+		return
+	}
+
+	if err := SetFileExpiry(uploaderUsername, folder, fileName, expiresAt); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "File expiry set", expiresAt)
+	}
+}
+
+// manageRetentionRulesHandler returns the retention rules of user_name (GET), or sets how
+// long (retention, e.g. "168h", or "0" to remove the rule) the files they record in a
+// folder (the root folder, i.e. all files, if not given) are kept (POST)
+func manageRetentionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	if username == "" {
+		SendResponse(w, false, "Please provide a username", nil)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if user, err := GetUserByUsername(username); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else if user.RetentionRules == nil {
+			SendResponse(w, true, "Retention rules", []RetentionRule{})
+		} else {
+			SendResponse(w, true, "Retention rules", user.RetentionRules)
+		}
+
+	case "POST":
+		retention, err := time.ParseDuration(r.FormValue("retention"))
+		if r.FormValue("retention") == "0" {
+			retention, err = 0, nil
+		}
+		if err != nil || retention < 0 {
+			SendResponse(w, false, "Invalid retention", nil)
+			return
+		}
+
+		if err := SetRetentionRule(username, r.FormValue("folder"), int64(retention.Seconds())); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Retention rule set", nil)
 		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// getShardPurgesHandler returns the pending shard purges of the host given in the host
+// query parameter: shards of deleted files that the host can delete
+func getShardPurgesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
 	}
 
-	return true, nil
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		SendResponse(w, false, "host query parameter not provided", nil)
+		return
+	}
+
+	if purges, err := GetShardPurges(host); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Shard purges", purges)
+	}
 }
 
-func getAwsStorageSizeHandler(w http.ResponseWriter, r *http.Request) {
+// confirmShardPurgeHandler records that a host has deleted the shards of a purge
+func confirmShardPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	id := r.FormValue("id")
+	host := r.FormValue("host")
+
+	if id == "" || host == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if purge, err := ConfirmShardPurge(id, host); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Shard purge confirmed", purge)
+	}
+}
+
+// manageMigrationsHandler returns the tier migrations of the files of the user given in
+// user_name with the given status (GET), including the pre-signed object URLs their node
+// needs to copy AWS tier files. Listing every user's migrations (no user_name) needs the
+// admin token and never includes the URLs. A POST request plans migrations straight away
+// rather than waiting for the planner, and needs the admin token.
+func manageMigrationsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		if size, err := GetTotalAwsStorageSize(); err == nil {
-			SendResponse(w, true, "Total AWS storage size", size)
+		username := r.URL.Query().Get("user_name")
+		if username == "" && !requireAdmin(w, r) {
+			return
+		}
+
+		if jobs, err := GetMigrationJobs(username, r.URL.Query().Get("status")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Migration jobs", jobs)
+		}
+
+	case "POST":
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		if planned, err := PlanMigrations(); err != nil {
+			SendResponse(w, false, err.Error(), nil)
 		} else {
+			SendResponse(w, true, "Migrations planned", planned)
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// completeMigrationHandler receives the outcome of a tier migration from the node of the
+// file's uploader (user_name)
+func completeMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	id := r.FormValue("id")
+	username := r.FormValue("user_name")
+	success := r.FormValue("success")
+
+	if id == "" || username == "" || (success != "true" && success != "false") {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if job, err := CompleteMigrationJob(id, username, success == "true"); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Migration "+job.Status, job)
+	}
+}
+
+// getTrashHandler returns the files in the trash of the user given in the user_name query
+// parameter, with when each will be deleted for good
+func getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	username := r.URL.Query().Get("user_name")
+	if username == "" {
+		SendResponse(w, false, "Please provide a username", nil)
+		return
+	}
+
+	if trash, err := GetTrash(username); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Trash", trash)
+	}
+}
+
+// restoreFromTrashHandler moves a file (every version of it) out of the trash
+func restoreFromTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	fileName := r.FormValue("file_name")
+	uploaderUsername := r.FormValue("uploader_username")
+	folder := r.FormValue("folder")
+
+	if fileName == "" || uploaderUsername == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if err := RestoreFile(uploaderUsername, folder, fileName); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "File restored", nil)
+	}
+}
+
+// manageFoldersHandler lists (GET, recursively if recursive=true), creates (POST) and
+// deletes (DELETE, moving the files in it to the trash unless permanent=true) the folder
+// at path of the user user_name. The listing only says where the files are stored if the
+// requester query parameter is user_name.
+func manageFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	folder := r.FormValue("path")
+
+	if username == "" {
+		SendResponse(w, false, "Please provide a username", nil)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if listing, err := ListFolder(username, folder, r.FormValue("recursive") == "true", r.FormValue("requester")); err != nil {
 			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Folder", listing)
 		}
 
 	case "POST":
-		r.ParseForm()
-		size, _ := strconv.Atoi(r.FormValue("size"))
+		if CleanFolderPath(folder) == "/" {
+			SendResponse(w, false, "Please provide a folder path", nil)
+			return
+		}
 
-		if success, err := IncrementAwsStorageUsed(float64(size)); err != nil {
+		if err := EnsureFolder(username, folder); err != nil {
 			SendResponse(w, false, err.Error(), nil)
 		} else {
-			totalAwsUsed, err := GetTotalAwsStorageUsed()
-			if err != nil {
-				SendResponse(w, false, err.Error(), nil)
-			}
+			SendResponse(w, true, "Folder created", CleanFolderPath(folder))
+		}
 
-			SendResponse(w, success, "Total AWS storage used", totalAwsUsed)
+	case "DELETE":
+		if deleted, err := DeleteFolder(username, folder, r.FormValue("permanent") == "true"); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Folder deleted", map[string]int{"files_deleted": deleted})
 		}
 
 	default:
-		fmt.Println("Invalid request method")
+		SendResponse(w, false, "Invalid request method", nil)
 	}
 }
 
-func getAwsStorageUsedHandler(w http.ResponseWriter, r *http.Request) {
-	totalAwsStorageUsed, err := GetTotalAwsStorageUsed()
-	if err != nil {
+// moveFolderHandler moves or renames the user's folder from to along with everything in it
+func moveFolderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	from := r.FormValue("from")
+	to := r.FormValue("to")
+
+	if username == "" || from == "" || to == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if err := MoveFolder(username, from, to); err != nil {
 		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Folder moved", CleanFolderPath(to))
 	}
+}
 
-	SendResponse(w, true, "Total AWS storage used", totalAwsStorageUsed)
+// manageSharesHandler lists the share grants user_name has made (GET, without the link
+// tokens, which are only returned when the link is created), shares a file read-only with
+// a grantee or through a link if no grantee is given (POST, optionally expiring after
+// expires_in seconds), and revokes a grant by its id (DELETE).
+func manageSharesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	if username == "" {
+		SendResponse(w, false, "Please provide a username", nil)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if grants, err := GetShareGrants(username); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Share grants", grants)
+		}
+
+	case "POST":
+		fileName := r.FormValue("file_name")
+		if fileName == "" {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
+
+		var expiresAt int64
+		if r.FormValue("expires_in") != "" {
+			expiresIn, err := strconv.ParseInt(r.FormValue("expires_in"), 10, 64)
+			if err != nil || expiresIn <= 0 {
+				SendResponse(w, false, "Invalid expires_in", nil)
+				return
+			}
+			expiresAt = time.Now().Unix() + expiresIn
+		}
+
+		if grant, err := InsertShareGrant(username, r.FormValue("folder"), fileName, r.FormValue("grantee"), expiresAt); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "File shared", grant)
+		}
+
+	case "DELETE":
+		if r.FormValue("id") == "" {
+			SendResponse(w, false, "id form key not provided", nil)
+			return
+		}
+
+		if grant, err := RevokeShareGrant(username, r.FormValue("id")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Share grant revoked", grant)
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// getSharedWithMeHandler returns the files shared with the user given in the user_name
+// query parameter
+func getSharedWithMeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	username := r.URL.Query().Get("user_name")
+	if username == "" {
+		SendResponse(w, false, "Please provide a username", nil)
+		return
+	}
+
+	if shared, err := GetFilesSharedWith(username); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Files shared with me", shared)
+	}
+}
+
+// managePublicKeyHandler returns (GET) or registers (POST) the public key of user_name that
+// file keys shared with them are wrapped to, along with its fingerprint for uploaders to
+// pin. Replacing a registered key (replace=true) needs the admin token.
+func managePublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	if username == "" {
+		SendResponse(w, false, "Please provide a username", nil)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		user, err := GetUserByUsername(username)
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		if user.PublicKey == "" {
+			SendResponse(w, false, "User has not registered a public key", nil)
+		} else {
+			SendResponse(w, true, "Public key", map[string]string{
+				"public_key":  user.PublicKey,
+				"fingerprint": publicKeyFingerprint(user.PublicKey),
+			})
+		}
+
+	case "POST":
+		replace := r.FormValue("replace") == "true"
+		if replace && !requireAdmin(w, r) {
+			return
+		}
+
+		if fingerprint, err := RegisterPublicKey(username, r.FormValue("public_key"), replace); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Public key registered", map[string]string{"fingerprint": fingerprint})
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// manageKeyEnvelopesHandler lets the uploader list (GET), store (POST, for recipient,
+// optionally pinning the fingerprint of the key it was wrapped to) and delete (DELETE, by
+// id) the wrapped keys of a version of their file (the latest if no version is given).
+// Recipients receive their envelope when they look the file up, unless they have replaced
+// their public key since, in which case the listing flags it as stale.
+func manageKeyEnvelopesHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	uploaderUsername := r.FormValue("uploader_username")
+	if uploaderUsername == "" {
+		SendResponse(w, false, "Please provide the uploader's username", nil)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if ok, err := DeleteKeyEnvelope(uploaderUsername, r.FormValue("id")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else if !ok {
+			SendResponse(w, false, "Key envelope not found", nil)
+		} else {
+			SendResponse(w, true, "Key envelope deleted", nil)
+		}
+		return
+	}
+
+	fileName := r.FormValue("file_name")
+	folder := r.FormValue("folder")
+	if fileName == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	var file UploadedFile
+	var err error
+	if version := r.FormValue("version"); version != "" {
+		versionInt, convErr := strconv.Atoi(version)
+		if convErr != nil {
+			SendResponse(w, false, "Invalid version", nil)
+			return
+		}
+		file, err = GetFileVersion(uploaderUsername, folder, fileName, versionInt)
+	} else {
+		file, err = GetUploadedFile(uploaderUsername, folder, fileName)
+	}
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if envelopes, err := GetKeyEnvelopes(file.ID.Hex()); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Key envelopes", envelopes)
+		}
+
+	case "POST":
+		recipient := r.FormValue("recipient")
+		if recipient == "" {
+			recipient = uploaderUsername
+		}
+
+		if envelope, err := PutKeyEnvelope(file, recipient, r.FormValue("wrapped_key"), r.FormValue("fingerprint")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Key envelope stored", envelope)
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// fileCorruptionHandler lists the corruption reports of a file (GET), or receives a
+// client's report that a shard it downloaded from a host did not match the shard's hash
+// (POST). The reporter must be able to read the file, and the host is challenged for the
+// shard before it is marked as holding a corrupt shard and a repair is planned
+func fileCorruptionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fileName := r.URL.Query().Get("file_name")
+		uploaderUsername := r.URL.Query().Get("uploader_username")
+		folder := r.URL.Query().Get("folder")
+
+		if fileName == "" || uploaderUsername == "" {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
+
+		file, err := GetUploadedFile(uploaderUsername, folder, fileName)
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		if reports, err := GetCorruptionReports(file.ID.Hex()); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Corruption reports", reports)
+		}
+
+	case "POST":
+		r.ParseForm()
+
+		fileName := r.FormValue("file_name")
+		uploaderUsername := r.FormValue("uploader_username")
+		folder := r.FormValue("folder")
+		host := r.FormValue("host")
+		reporter := r.FormValue("user_name")
+		actualHash := r.FormValue("actual_hash")
+		shardIndex, err := strconv.Atoi(r.FormValue("shard_index"))
+
+		if fileName == "" || uploaderUsername == "" || host == "" || reporter == "" || actualHash == "" || err != nil {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
+
+		if _, err := GetUserByUsername(reporter); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		file, err := GetUploadedFile(uploaderUsername, folder, fileName)
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		if canRead, err := CanReadFile(file, reporter, ""); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		} else if !canRead {
+			SendResponse(w, false, "File is not shared with the reporter", nil)
+			return
+		}
+
+		if report, err := ReportShardCorruption(file, shardIndex, host, reporter, actualHash); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Corruption reported", report)
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// storeFileHandler is called before a file is to be uploaded. It tells the node
+// where to store the file and if they can store it.
+//
+// If the user is a monthly subscriber, then they should be told to store their file
+// in AWS except in situations where the storage pool can satisfy all the Fixed Amount
+// customers, in that case their file would be stored in the storage pool.
+// If the user is a Fixed Amount customer, then they should be told to store their file
+// in the storage pool except in situations where the storage pool is full, in that case
+// their file would be stored in AWS.
+//
+// If the node sends the number of shards (and optionally backup_shards, replicas and its
+// user_name), the response is a StorePlacement naming the hosts to send each shard to.
+// If it also sends the file's content_hash and shard_leaf_counts, the placement includes a
+// DedupChallenge: answering it with /file records the file without uploading it if the
+// content is already stored (see file_deduplication_operations.go). If the file goes to AWS
+// and the server manages the object store, the placement holds the object key to record the
+// file with and a pre-signed URL to upload it to.
+func storeFileHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	if r.FormValue("file_size_gb") == "" {
+		SendResponse(w, false, "file_size_gb form key not specified", nil)
+		return
+	}
+
+	if r.FormValue("account_type") == "" {
+		SendResponse(w, false, "account_type form key not specified", nil)
+		return
+	}
+
+	fileSizeGB, _ := strconv.Atoi(r.FormValue("file_size_gb"))
+	accountType := r.FormValue("account_type")
+
+	totalStoragePoolSize, err := GetTotalStoragePoolSize()
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	var location string
+
+	if accountType == MONTHLY_SUB {
+		// Check if the storage pool can satisfy the file
+		numberOfFixedAmounts1, err := GetNumberOfFixedAmount1Subs()
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		numberOfFixedAmounts2, err := GetNumberOfFixedAmount2Subs()
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		if float64(numberOfFixedAmounts1*1000) >= totalStoragePoolSize+float64(fileSizeGB) {
+			// Storage pool cannot satisfy the file
+			location = "aws"
+		} else if float64(numberOfFixedAmounts2*2000) >= totalStoragePoolSize+float64(fileSizeGB) {
+			// Storage pool cannot satisfy the file
+			location = "aws"
+		} else {
+			// Storage pool can satisfy the file
+			location = "spool"
+		}
+	} else if accountType == FIXED_AMOUNT_1 {
+		// Check if the storage pool can satisfy the file
+		if float64(fileSizeGB) < totalStoragePoolSize {
+			// Storage pool can satisfy the file
+			location = "spool"
+		} else {
+			// Storage pool cannot satisfy the file
+			location = "aws"
+		}
+	} else if accountType == FIXED_AMOUNT_2 {
+		// Check if the storage pool can satisfy the file
+		if float64(fileSizeGB) < totalStoragePoolSize {
+			// Storage pool can satisfy the file
+			location = "spool"
+		} else {
+			// Storage pool cannot satisfy the file
+			location = "aws"
+		}
+	} else {
+		SendResponse(w, false, fmt.Sprintf("Invalid account type [%v]", accountType), nil)
+		return
+	}
+
+	// Without a shard count only the location is returned, as older nodes expect
+	if r.FormValue("shards") == "" {
+		SendResponse(w, true, "location", location)
+		return
+	}
+
+	shards, err := strconv.Atoi(r.FormValue("shards"))
+	if err != nil || shards <= 0 {
+		SendResponse(w, false, "Invalid shards parameter", nil)
+		return
+	}
+
+	backupShards := 0
+	if r.FormValue("backup_shards") != "" {
+		if backupShards, err = strconv.Atoi(r.FormValue("backup_shards")); err != nil || backupShards < 0 {
+			SendResponse(w, false, "Invalid backup_shards parameter", nil)
+			return
+		}
+	}
+
+	replicas := STORE_DEFAULT_REPLICAS
+	if r.FormValue("replicas") != "" {
+		if replicas, err = strconv.Atoi(r.FormValue("replicas")); err != nil || replicas <= 0 {
+			SendResponse(w, false, "Invalid replicas parameter", nil)
+			return
+		}
+	}
+
+	// The exact size is needed for the shards, not the whole gigabytes used above
+	fileSize, _ := strconv.ParseFloat(r.FormValue("file_size_gb"), 64)
+
+	placement := StorePlacement{
+		Location:  location,
+		ShardSize: fileSize / float64(shards),
+	}
+
+	if location == "spool" {
+		hosts, err := SelectShardHosts(shards+backupShards, replicas, placement.ShardSize, r.FormValue("user_name"))
+		if err != nil {
+			// Not enough hosts can take the shards, so the file has to go to AWS
+			log.Println("Unable to place file in the storage pool:", err)
+			placement.Location = "aws"
+		} else {
+			placement.Placement = hosts
+
+			if availability, err := GetFileAvailability(hosts, shards); err != nil {
+				log.Println("Unable to estimate file availability:", err)
+			} else {
+				placement.Availability = &availability
+			}
+		}
+	}
+
+	// Whether the content is already stored is only revealed to a node that proves it holds it
+	if r.FormValue("content_hash") != "" && r.FormValue("shard_leaf_counts") != "" && r.FormValue("user_name") != "" {
+		var leafCounts []int
+		if err := json.Unmarshal([]byte(r.FormValue("shard_leaf_counts")), &leafCounts); err != nil {
+			SendResponse(w, false, "Invalid shard_leaf_counts", nil)
+			return
+		}
+
+		challenge, err := IssueDedupChallenge(r.FormValue("user_name"), r.FormValue("content_hash"), shards, backupShards, leafCounts)
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+		placement.DedupChallenge = &challenge
+	}
+
+	// The node uploads AWS tier files straight to the object store, without its credentials
+	if placement.Location == "aws" && objectStore != nil && r.FormValue("user_name") != "" {
+		placement.ObjectKey = newObjectKey(r.FormValue("user_name"))
+		if placement.UploadURL, err = objectStore.PresignPut(placement.ObjectKey, OBJECT_URL_EXPIRY); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+		placement.UploadURLExpiresAt = time.Now().Add(OBJECT_URL_EXPIRY).Unix()
+	}
+
+	SendResponse(w, true, "location", placement)
+}
+
+// getStoragePoolUsedHandler handles sending the total storage pool used when a GET request is made
+// and handles incrementing the total storage pool used when a POST request is made
+func getStoragePoolUsedHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET": // Get storage pool used
+		storagePoolUsed, err := GetStoragePoolUsed()
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Total storage pool used", storagePoolUsed)
+		}
+
+	case "POST": // Increment storage pool used
+		r.ParseForm()
+		size, _ := strconv.Atoi(r.FormValue("size"))
+
+		// Ensure that the storage pool is not full
+		if ok, err := updateStoragePoolUsed(float64(size)); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			if ok {
+				SendResponse(w, true, "Storage pool used incremented", nil)
+			} else {
+				SendResponse(w, false, "Storage pool is full", nil)
+			}
+		}
+	}
+}
+
+func updateStoragePoolUsed(fileSize float64) (bool, error) {
+	// Update the storage pool used
+	storagePoolAvailable, err := GetTotalStoragePoolSize()
+	if err != nil {
+		return false, err
+	}
+
+	totalStoragePoolUsed, err := GetStoragePoolUsed()
+	if err != nil {
+		return false, err
+	}
+
+	if storagePoolAvailable-totalStoragePoolUsed <= float64(fileSize) {
+		log.Println("Storage pool is full")
+		TriggerNetworkAlertEvaluation()
+		return false, nil
+	}
+
+	// Increment the storage pool used
+	if ok, err := IncrementStoragePoolUsed(float64(fileSize)); err != nil {
+		return false, err
+	} else {
+		if !ok {
+			return false, fmt.Errorf("failed to increment storage pool used")
+		}
+	}
+
+	return true, nil
+}
+
+func updateAWSstorageUsed(fileSize float64) (bool, error) {
+	// Update the AWS storage used
+	awsStorageAvailable, err := GetTotalAwsStorageSize()
+	if err != nil {
+		return false, err
+	}
+
+	totalAwsStorageUsed, err := GetTotalAwsStorageUsed()
+	if err != nil {
+		return false, err
+	}
+
+	if awsStorageAvailable-totalAwsStorageUsed <= float64(fileSize) {
+		log.Println("AWS storage is full")
+		TriggerNetworkAlertEvaluation()
+		return false, nil
+	}
+
+	// Increment the AWS storage used
+	if ok, err := IncrementAwsStorageUsed(float64(fileSize)); err != nil {
+		return false, err
+	} else {
+		if !ok {
+			return false, fmt.Errorf("failed to increment AWS storage used")
+		}
+	}
+
+	return true, nil
+}
+
+func getAwsStorageSizeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if size, err := GetTotalAwsStorageSize(); err == nil {
+			SendResponse(w, true, "Total AWS storage size", size)
+		} else {
+			SendResponse(w, false, err.Error(), nil)
+		}
+
+	case "POST":
+		r.ParseForm()
+		size, _ := strconv.Atoi(r.FormValue("size"))
+
+		if success, err := IncrementAwsStorageUsed(float64(size)); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			totalAwsUsed, err := GetTotalAwsStorageUsed()
+			if err != nil {
+				SendResponse(w, false, err.Error(), nil)
+			}
+
+			SendResponse(w, success, "Total AWS storage used", totalAwsUsed)
+		}
+
+	default:
+		fmt.Println("Invalid request method")
+	}
+}
+
+func getAwsStorageUsedHandler(w http.ResponseWriter, r *http.Request) {
+	totalAwsStorageUsed, err := GetTotalAwsStorageUsed()
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	}
+
+	SendResponse(w, true, "Total AWS storage used", totalAwsStorageUsed)
+}
+
+// getNetworkOverviewHandler returns the network storage state along with the free
+// capacity, utilisation and subscriber breakdown derived from it. The response carries
+// an ETag so that pollers can send If-None-Match and get a 304 when nothing changed.
+func getNetworkOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	overview, err := GetNetworkOverview()
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	jsonData, err := json.MarshalIndent(Response{Success: true, Message: "Network overview", Data: overview}, "", "    ")
+	if err != nil {
+		SendResponse(w, false, err.Error(), nil)
+		return
+	}
+
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(jsonData))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// etagMatches reports whether an If-None-Match header value matches the given ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getNetworkHistoryHandler returns the network storage history between the from and to
+// query parameters (unix time), downsampled to one point per step seconds. Without
+// parameters it returns the last 30 days.
+func getNetworkHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	queryParams := r.URL.Query()
+
+	to := time.Now().Unix()
+	if queryParams.Get("to") != "" {
+		value, err := strconv.ParseInt(queryParams.Get("to"), 10, 64)
+		if err != nil {
+			SendResponse(w, false, "Invalid to parameter", nil)
+			return
+		}
+		to = value
+	}
+
+	from := to - NETWORK_HISTORY_DEFAULT_RANGE
+	if queryParams.Get("from") != "" {
+		value, err := strconv.ParseInt(queryParams.Get("from"), 10, 64)
+		if err != nil {
+			SendResponse(w, false, "Invalid from parameter", nil)
+			return
+		}
+		from = value
+	}
+
+	// The default step never drops below a second, however short the range
+	step := (to - from) / NETWORK_HISTORY_DEFAULT_POINTS
+	if step <= 0 {
+		step = 1
+	}
+	if queryParams.Get("step") != "" {
+		value, err := strconv.ParseInt(queryParams.Get("step"), 10, 64)
+		if err != nil || value <= 0 {
+			SendResponse(w, false, "Invalid step parameter", nil)
+			return
+		}
+		step = value
+	}
+
+	if points, err := GetNetworkHistory(from, to, step); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Network history", points)
+	}
+}
+
+// getNetworkForecastHandler returns the capacity forecast. The optional window query
+// parameter is the number of days of history to fit, and horizon is the number of days
+// ahead to project the monthly subscriber demand.
+func getNetworkForecastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	queryParams := r.URL.Query()
+
+	window := int64(NETWORK_FORECAST_DEFAULT_WINDOW)
+	if queryParams.Get("window") != "" {
+		value, err := strconv.ParseInt(queryParams.Get("window"), 10, 64)
+		if err != nil || value <= 0 {
+			SendResponse(w, false, "Invalid window parameter", nil)
+			return
+		}
+		window = value
+	}
+
+	horizon := int64(NETWORK_FORECAST_DEFAULT_HORIZON)
+	if queryParams.Get("horizon") != "" {
+		value, err := strconv.ParseInt(queryParams.Get("horizon"), 10, 64)
+		if err != nil || value < 0 {
+			SendResponse(w, false, "Invalid horizon parameter", nil)
+			return
+		}
+		horizon = value
+	}
+
+	if forecast, err := GetNetworkForecast(window, horizon); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Network forecast", forecast)
+	}
+}
+
+// networkStateEventsHandler streams a NetworkStorageState snapshot to the client every
+// time one of the network counters changes. Clients reconnecting with a Last-Event-ID
+// header receive the events they missed, or a fresh snapshot if those are no longer kept.
+func networkStateEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		SendResponse(w, false, "Streaming not supported", nil)
+		return
+	}
+
+	lastEventID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if lastEventID == 0 {
+		lastEventID, _ = strconv.ParseInt(r.URL.Query().Get("last_event_id"), 10, 64)
+	}
+
+	events, missed, resumed := networkStateEvents.Subscribe(lastEventID)
+	defer networkStateEvents.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if !resumed {
+		// The client is new or too far behind, so start it off with the current state
+		var state NetworkStorageState
+		if err := findNetworkStateInMongo(&state); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		missed = []NetworkStateEvent{{ID: networkStateEvents.LastEventID(), State: state}}
+	}
+
+	for _, event := range missed {
+		if err := writeNetworkStateEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(NETWORK_STATE_KEEPALIVE_INTERVAL * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeNetworkStateEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeNetworkStateEvent writes a single network state event in the SSE wire format
+func writeNetworkStateEvent(w http.ResponseWriter, event NetworkStateEvent) error {
+	jsonData, err := json.Marshal(event.State)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: network-state\ndata: %s\n\n", event.ID, jsonData)
+	return err
+}
+
+// getAlertsHandler returns the alerts that are currently firing
+func getAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	SendResponse(w, true, "Active alerts", alerts.Active())
+}
+
+// manageAlertRulesHandler lists the alert rules (GET), creates or replaces a rule (POST)
+// and deletes a rule (DELETE). Changing the rules is for admins only.
+func manageAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !requireAdmin(w, r) {
+		return
+	}
+	r.ParseForm()
+
+	switch r.Method {
+	case "GET":
+		if rules, err := GetAlertRules(); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Alert rules", rules)
+		}
+
+	case "POST":
+		name := r.FormValue("name")
+		kind := r.FormValue("kind")
+		threshold, err := strconv.ParseFloat(r.FormValue("threshold"), 64)
+
+		if name == "" || kind == "" || err != nil {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
+
+		rule := AlertRule{
+			Name:      name,
+			Kind:      kind,
+			Threshold: threshold,
+			Enabled:   r.FormValue("enabled") != "false",
+		}
+
+		if err := SaveAlertRule(rule); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		TriggerNetworkAlertEvaluation()
+		SendResponse(w, true, "Alert rule saved", rule)
+
+	case "DELETE":
+		if r.FormValue("name") == "" {
+			SendResponse(w, false, "name form key not provided", nil)
+			return
+		}
+
+		if ok, err := DeleteAlertRule(r.FormValue("name")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			if ok {
+				TriggerNetworkAlertEvaluation()
+				SendResponse(w, true, "Alert rule deleted", nil)
+			} else {
+				SendResponse(w, false, "Alert rule not found", nil)
+			}
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// manageWebhooksHandler lists the webhook subscriptions (GET), subscribes a URL to a
+// comma separated list of event types (POST) and removes a subscription (DELETE)
+func manageWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	r.ParseForm()
+
+	switch r.Method {
+	case "GET":
+		subscriptions, err := GetWebhookSubscriptions()
+		if err != nil {
+			SendResponse(w, false, err.Error(), nil)
+			return
+		}
+
+		// Secrets are only shown once, when the subscription is created
+		for i := range subscriptions {
+			subscriptions[i].Secret = ""
+		}
+		SendResponse(w, true, "Webhook subscriptions", subscriptions)
+
+	case "POST":
+		webhookURL := r.FormValue("url")
+		eventTypes := r.FormValue("event_types")
+
+		if webhookURL == "" || eventTypes == "" {
+			SendResponse(w, false, "Invalid parameters", nil)
+			return
+		}
+
+		subscription := WebhookSubscription{
+			URL:        webhookURL,
+			EventTypes: strings.Split(eventTypes, ","),
+			Secret:     r.FormValue("secret"),
+		}
+
+		if subscription, err := InsertWebhookSubscription(subscription); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Webhook subscription created", subscription)
+		}
+
+	case "DELETE":
+		if r.FormValue("id") == "" {
+			SendResponse(w, false, "id form key not provided", nil)
+			return
+		}
+
+		if ok, err := DeleteWebhookSubscription(r.FormValue("id")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			if ok {
+				SendResponse(w, true, "Webhook subscription deleted", nil)
+			} else {
+				SendResponse(w, false, "Webhook subscription not found", nil)
+			}
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// manageWebhookDeadLettersHandler lists the events that could not be delivered (GET),
+// retries delivering one (POST) and discards one (DELETE)
+func manageWebhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	r.ParseForm()
+
+	switch r.Method {
+	case "GET":
+		if deadLetters, err := GetWebhookDeadLetters(); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Webhook dead letters", deadLetters)
+		}
+
+	case "POST":
+		if r.FormValue("id") == "" {
+			SendResponse(w, false, "id form key not provided", nil)
+			return
+		}
+
+		if err := RedeliverWebhookDeadLetter(r.FormValue("id")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			SendResponse(w, true, "Webhook event redelivery started", nil)
+		}
+
+	case "DELETE":
+		if r.FormValue("id") == "" {
+			SendResponse(w, false, "id form key not provided", nil)
+			return
+		}
+
+		if ok, err := DeleteWebhookDeadLetter(r.FormValue("id")); err != nil {
+			SendResponse(w, false, err.Error(), nil)
+		} else {
+			if ok {
+				SendResponse(w, true, "Webhook dead letter deleted", nil)
+			} else {
+				SendResponse(w, false, "Webhook dead letter not found", nil)
+			}
+		}
+
+	default:
+		SendResponse(w, false, "Invalid request method", nil)
+	}
+}
+
+// hostHeartbeatHandler is called periodically by every node to report that it is online
+// and how much free space it contributes to the storage pool
+func hostHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	freeSpace, err := strconv.ParseFloat(r.FormValue("free_space"), 64)
+
+	if username == "" || err != nil || freeSpace < 0 {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if host, err := RecordHeartbeat(username, r.FormValue("address"), r.FormValue("relay_address"), freeSpace); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Heartbeat recorded", host)
+	}
+}
+
+// getPeersHandler returns up to amount distinct random hosts. The caller (user_name) is
+// never included, and the results can be filtered by status (default online), timezone
+// (both comma separated) and min_free_space in gigabytes.
+func getPeersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	queryParams := r.URL.Query()
+
+	amount, err := strconv.Atoi(queryParams.Get("amount"))
+	if err != nil || amount <= 0 || amount > PEER_DISCOVERY_MAX_AMOUNT {
+		SendResponse(w, false, fmt.Sprintf("amount must be between 1 and %v", PEER_DISCOVERY_MAX_AMOUNT), nil)
+		return
+	}
+
+	query := PeerQuery{
+		Amount:  amount,
+		Exclude: queryParams.Get("user_name"),
+	}
+
+	if status := queryParams.Get("status"); status != "" {
+		query.Statuses = strings.Split(status, ",")
+	}
+	if timezone := queryParams.Get("timezone"); timezone != "" {
+		query.Timezones = strings.Split(timezone, ",")
+	}
+	if minFreeSpace := queryParams.Get("min_free_space"); minFreeSpace != "" {
+		if query.MinFreeSpace, err = strconv.ParseFloat(minFreeSpace, 64); err != nil {
+			SendResponse(w, false, "Invalid min_free_space parameter", nil)
+			return
+		}
+	}
+
+	if peers, err := DiscoverPeers(query); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Peers", peers)
+	}
+}
+
+// getReputationHandler returns the current reputation of the host of the user given in
+// the user_name query parameter, with the components the score is made of
+func getReputationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	username := r.URL.Query().Get("user_name")
+	if username == "" {
+		SendResponse(w, false, "user_name query parameter not provided", nil)
+		return
+	}
+
+	if reputation, err := GetReputation(username); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Reputation", reputation)
+	}
+}
+
+// getHostsHandler returns the registered hosts. The optional status query parameter is a
+// comma separated list of online, stale and dead.
+func getHostsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	var statuses []string
+	if status := r.URL.Query().Get("status"); status != "" {
+		statuses = strings.Split(status, ",")
+	}
+
+	if hosts, err := GetHosts(statuses...); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Hosts", hosts)
+	}
+}
+
+// getRepairJobsHandler returns the repair jobs of the host given in the host query
+// parameter. Hosts poll this to find the shards they should copy or receive.
+func getRepairJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	status := queryParams.Get("status")
+	if status == "" {
+		status = REPAIR_PENDING
+	}
+
+	if jobs, err := GetRepairJobs(queryParams.Get("host"), status); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Repair jobs", jobs)
+	}
+}
+
+// confirmRepairJobHandler is called by the source or target host of a repair job once the
+// shard has been copied (success=true) or the copy could not be made (success=false)
+func confirmRepairJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	id := r.FormValue("id")
+	host := r.FormValue("host")
+	success := r.FormValue("success")
+
+	if id == "" || host == "" || (success != "true" && success != "false") {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if job, err := ConfirmRepairJob(id, host, success == "true"); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Repair job "+job.Status, job)
+	}
+}
+
+// getStorageChallengesHandler returns the pending storage challenges of the host given in
+// the host query parameter
+func getStorageChallengesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		SendResponse(w, false, "host query parameter not provided", nil)
+		return
+	}
+
+	if challenges, err := GetStorageChallenges(host); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Storage challenges", challenges)
+	}
+}
+
+// respondToStorageChallengeHandler receives a host's answer to a storage challenge: the
+// challenged chunk (base64) and its Merkle proof (a JSON array of hex hashes)
+func respondToStorageChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	id := r.FormValue("id")
+	host := r.FormValue("host")
+
+	if id == "" || host == "" || r.FormValue("chunk") == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	chunk, err := base64.StdEncoding.DecodeString(r.FormValue("chunk"))
+	if err != nil {
+		SendResponse(w, false, "Invalid chunk encoding", nil)
+		return
+	}
+
+	var proof []string
+	if r.FormValue("proof") != "" {
+		if err := json.Unmarshal([]byte(r.FormValue("proof")), &proof); err != nil {
+			SendResponse(w, false, "Invalid proof", nil)
+			return
+		}
+	}
+
+	if challenge, err := RespondToStorageChallenge(id, host, chunk, proof); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, challenge.Status == CHALLENGE_PASSED, "Storage challenge "+challenge.Status, challenge)
+	}
+}
+
+// registerEndpointsHandler records the endpoints (a JSON array of addresses) a node can
+// currently be reached at, and the relay it is attached to
+func registerEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	username := r.FormValue("user_name")
+	if username == "" || r.FormValue("endpoints") == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	var endpoints []string
+	if err := json.Unmarshal([]byte(r.FormValue("endpoints")), &endpoints); err != nil {
+		SendResponse(w, false, "Invalid endpoints", nil)
+		return
+	}
+
+	if host, err := RegisterEndpoints(username, endpoints, r.FormValue("relay_address")); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Endpoints registered", host)
+	}
+}
+
+// requestIntroductionHandler starts brokering a connection from the node given in from to
+// the node given in to, returning the target's endpoints
+func requestIntroductionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	from := r.FormValue("from")
+	to := r.FormValue("to")
+	if from == "" || to == "" {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if introduction, err := RequestIntroduction(from, to); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Introduction requested", introduction)
+	}
+}
+
+// getIntroductionsHandler returns the pending introductions involving the user given in
+// the user_name query parameter
+func getIntroductionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+
+	username := r.URL.Query().Get("user_name")
+	if username == "" {
+		SendResponse(w, false, "user_name query parameter not provided", nil)
+		return
+	}
+
+	if introductions, err := GetIntroductions(username); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Introductions", introductions)
+	}
+}
+
+// reportIntroductionHandler records whether a node managed to connect in the introduction's
+// current stage (direct or relay)
+func reportIntroductionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		SendResponse(w, false, "Invalid request method", nil)
+		return
+	}
+	r.ParseForm()
+
+	id := r.FormValue("id")
+	username := r.FormValue("user_name")
+	success := r.FormValue("success")
+
+	if id == "" || username == "" || (success != "true" && success != "false") {
+		SendResponse(w, false, "Invalid parameters", nil)
+		return
+	}
+
+	if introduction, err := ReportIntroduction(id, username, success == "true"); err != nil {
+		SendResponse(w, false, err.Error(), nil)
+	} else {
+		SendResponse(w, true, "Introduction "+introduction.Status, introduction)
+	}
 }
 
 // SendResponse sends a response to the requester
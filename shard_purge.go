@@ -0,0 +1,15 @@
+package main
+
+// ShardPurge tells a host that the file it holds shards of is gone, so that it can delete
+// them and reclaim the space. Hosts poll for their pending purges and confirm them.
+type ShardPurge struct {
+	ID           string `bson:"id" json:"id"`
+	FileID       string `bson:"file_id" json:"file_id"`
+	FileName     string `bson:"file_name" json:"file_name"`
+	Host         string `bson:"host" json:"host"`
+	ShardIndexes []int  `bson:"shard_indexes" json:"shard_indexes"`
+	Reason       string `bson:"reason" json:"reason"`
+	Status       string `bson:"status" json:"status"`
+	CreatedAt    int64  `bson:"created_at" json:"created_at"` // in unix time
+	UpdatedAt    int64  `bson:"updated_at" json:"updated_at"` // in unix time
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PlanShardPurges asks every host of the file to delete the shards it holds. It is called
+// once no file refers to the content any more.
+func PlanShardPurges(file UploadedFile, reason string) error {
+	shardIndexes := make(map[string][]int)
+	var hosts []string
+	for shardIndex, shardHosts := range file.Hosts {
+		for _, host := range shardHosts {
+			if _, ok := shardIndexes[host]; !ok {
+				hosts = append(hosts, host)
+			}
+			shardIndexes[host] = append(shardIndexes[host], shardIndex)
+		}
+	}
+
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	purges := make([]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		purges = append(purges, ShardPurge{
+			ID:           primitive.NewObjectID().Hex(),
+			FileID:       file.ID.Hex(),
+			FileName:     file.FileName,
+			Host:         host,
+			ShardIndexes: shardIndexes[host],
+			Reason:       reason,
+			Status:       PURGE_PENDING,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		})
+	}
+
+	_, err := shardPurgesColl.InsertMany(context.Background(), purges)
+	return err
+}
+
+// GetShardPurges returns the pending purges of the host.
+func GetShardPurges(host string) ([]ShardPurge, error) {
+	filter := bson.D{{Key: "host", Value: host}, {Key: "status", Value: PURGE_PENDING}}
+
+	cursor, err := shardPurgesColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	purges := []ShardPurge{}
+	if err := cursor.All(context.Background(), &purges); err != nil {
+		return nil, err
+	}
+
+	return purges, nil
+}
+
+// ConfirmShardPurge records that the host has deleted the shards of the purge.
+func ConfirmShardPurge(id string, host string) (ShardPurge, error) {
+	filter := bson.D{{Key: "id", Value: id}, {Key: "host", Value: host}, {Key: "status", Value: PURGE_PENDING}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: PURGE_CONFIRMED},
+		{Key: "updated_at", Value: time.Now().Unix()},
+	}}}
+
+	var purge ShardPurge
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := shardPurgesColl.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&purge); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ShardPurge{}, fmt.Errorf("pending shard purge not found")
+		}
+		return ShardPurge{}, err
+	}
+
+	return purge, nil
+}
+
+// deleteOldShardPurges forgets the purges older than PURGE_RETENTION, whether or not the
+// host confirmed them.
+func deleteOldShardPurges() error {
+	cutoff := time.Now().Add(-PURGE_RETENTION).Unix()
+
+	_, err := shardPurgesColl.DeleteMany(context.Background(), bson.D{{Key: "created_at", Value: bson.D{{Key: "$lt", Value: cutoff}}}})
+	return err
+}
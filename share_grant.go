@@ -0,0 +1,21 @@
+package main
+
+// ShareGrant gives read-only access to every version of a file to another user, or to
+// anyone holding the link token if Grantee is empty. Grants last until revoked or, if
+// ExpiresAt is set, until they expire.
+type ShareGrant struct {
+	ID        string `bson:"id" json:"id"`
+	Owner     string `bson:"owner" json:"owner"` // the file's uploader
+	Folder    string `bson:"folder" json:"folder"`
+	FileName  string `bson:"file_name" json:"file_name"`
+	Grantee   string `bson:"grantee,omitempty" json:"grantee,omitempty"`
+	Token     string `bson:"token,omitempty" json:"token,omitempty"` // for link grants, only returned on creation
+	CreatedAt int64  `bson:"created_at" json:"created_at"`           // in unix time
+	ExpiresAt int64  `bson:"expires_at" json:"expires_at"`           // in unix time, 0 for never
+}
+
+// SharedFile is a file shared with a user, along with the grant sharing it.
+type SharedFile struct {
+	Grant ShareGrant   `json:"grant"`
+	File  UploadedFile `json:"file"`
+}
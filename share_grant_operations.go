@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// activeGrantFilter matches the grants that have not expired.
+func activeGrantFilter(now int64) bson.E {
+	return bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "expires_at", Value: 0}},
+		bson.D{{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: now}}}},
+	}}
+}
+
+// InsertShareGrant shares the owner's file with the grantee, or through a new link token
+// if grantee is empty.
+func InsertShareGrant(owner string, folder string, fileName string, grantee string, expiresAt int64) (ShareGrant, error) {
+	if _, err := GetUploadedFile(owner, folder, fileName); err != nil {
+		return ShareGrant{}, err
+	}
+
+	now := time.Now().Unix()
+	if expiresAt != 0 && expiresAt <= now {
+		return ShareGrant{}, fmt.Errorf("expiry is in the past")
+	}
+
+	grant := ShareGrant{
+		ID:        primitive.NewObjectID().Hex(),
+		Owner:     owner,
+		Folder:    CleanFolderPath(folder),
+		FileName:  fileName,
+		Grantee:   grantee,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+
+	if grantee != "" {
+		if grantee == owner {
+			return ShareGrant{}, fmt.Errorf("a file cannot be shared with its owner")
+		}
+		if _, err := GetUserByUsername(grantee); err != nil {
+			return ShareGrant{}, err
+		}
+	} else {
+		token := make([]byte, 32)
+		if _, err := rand.Read(token); err != nil {
+			return ShareGrant{}, err
+		}
+		grant.Token = hex.EncodeToString(token)
+	}
+
+	if _, err := shareGrantsColl.InsertOne(context.Background(), grant); err != nil {
+		return ShareGrant{}, err
+	}
+
+	return grant, nil
+}
+
+// GetShareGrants returns the grants the owner has made, including expired ones. Link
+// tokens are left out: whoever holds one can read the file.
+func GetShareGrants(owner string) ([]ShareGrant, error) {
+	cursor, err := shareGrantsColl.Find(context.Background(), bson.D{{Key: "owner", Value: owner}})
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []ShareGrant{}
+	if err := cursor.All(context.Background(), &grants); err != nil {
+		return nil, err
+	}
+
+	for i := range grants {
+		grants[i].Token = ""
+	}
+
+	return grants, nil
+}
+
+// RevokeShareGrant deletes the owner's grant with the given ID.
+func RevokeShareGrant(owner string, id string) (ShareGrant, error) {
+	var grant ShareGrant
+	filter := bson.D{{Key: "id", Value: id}, {Key: "owner", Value: owner}}
+	if err := shareGrantsColl.FindOneAndDelete(context.Background(), filter).Decode(&grant); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ShareGrant{}, fmt.Errorf("share grant not found")
+		}
+		return ShareGrant{}, err
+	}
+
+	// The file keys wrapped to the grantee must not outlive the grant
+	if grant.Grantee != "" {
+		if err := revokeKeyEnvelopes(grant.Owner, grant.Folder, grant.FileName, grant.Grantee); err != nil {
+			return ShareGrant{}, err
+		}
+	}
+
+	return grant, nil
+}
+
+// GetShareGrantByToken returns the active link grant with the given token.
+func GetShareGrantByToken(token string) (ShareGrant, error) {
+	filter := bson.D{{Key: "token", Value: token}, activeGrantFilter(time.Now().Unix())}
+
+	var grant ShareGrant
+	if err := shareGrantsColl.FindOne(context.Background(), filter).Decode(&grant); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ShareGrant{}, fmt.Errorf("invalid or expired share link")
+		}
+		return ShareGrant{}, err
+	}
+
+	return grant, nil
+}
+
+// CanReadFile reports whether the requester may see where the file is stored: they must
+// be its uploader, have an active grant for it, or hold an active link token for it.
+func CanReadFile(file UploadedFile, requester string, token string) (bool, error) {
+	if requester != "" && requester == file.UploaderUsername {
+		return true, nil
+	}
+
+	if requester == "" && token == "" {
+		return false, nil
+	}
+
+	filter := bson.D{
+		{Key: "owner", Value: file.UploaderUsername},
+		{Key: "folder", Value: CleanFolderPath(file.Folder)},
+		{Key: "file_name", Value: file.FileName},
+		activeGrantFilter(time.Now().Unix()),
+	}
+	if token != "" {
+		filter = append(filter, bson.E{Key: "token", Value: token})
+	} else {
+		filter = append(filter, bson.E{Key: "grantee", Value: requester})
+	}
+
+	count, err := shareGrantsColl.CountDocuments(context.Background(), filter)
+	return count > 0, err
+}
+
+// GetFilesSharedWith returns the latest version of every file shared with the user by an
+// active grant.
+func GetFilesSharedWith(username string) ([]SharedFile, error) {
+	filter := bson.D{{Key: "grantee", Value: username}, activeGrantFilter(time.Now().Unix())}
+	cursor, err := shareGrantsColl.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []ShareGrant
+	if err := cursor.All(context.Background(), &grants); err != nil {
+		return nil, err
+	}
+
+	shared := []SharedFile{}
+	for _, grant := range grants {
+		file, err := GetUploadedFile(grant.Owner, grant.Folder, grant.FileName)
+		if err != nil {
+			continue
+		}
+		if file, err = FileForRequester(file, username, ""); err != nil {
+			return nil, err
+		}
+		shared = append(shared, SharedFile{Grant: grant, File: file})
+	}
+
+	return shared, nil
+}
+
+// moveShareGrants makes the grants of a file follow it when it is moved or renamed.
+func moveShareGrants(owner string, folder string, fileName string, newFolder string, newName string) error {
+	filter := bson.D{
+		{Key: "owner", Value: owner},
+		{Key: "folder", Value: CleanFolderPath(folder)},
+		{Key: "file_name", Value: fileName},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "folder", Value: CleanFolderPath(newFolder)},
+		{Key: "file_name", Value: newName},
+	}}}
+
+	_, err := shareGrantsColl.UpdateMany(context.Background(), filter, update)
+	return err
+}
+
+// deleteShareGrants deletes the grants of a file that no longer exists.
+func deleteShareGrants(owner string, folder string, fileName string) error {
+	filter := bson.D{
+		{Key: "owner", Value: owner},
+		{Key: "folder", Value: CleanFolderPath(folder)},
+		{Key: "file_name", Value: fileName},
+	}
+
+	_, err := shareGrantsColl.DeleteMany(context.Background(), filter)
+	return err
+}
+
+// FileForRequester returns the file as the requester may see it: with its hosts, shard
+// metadata, the file key wrapped to them and (for the AWS tier) a download URL if they can
+// read it, and without them otherwise.
+func FileForRequester(file UploadedFile, requester string, token string) (UploadedFile, error) {
+	canRead, err := CanReadFile(file, requester, token)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+
+	if !canRead {
+		return file.WithoutStorageDetails(), nil
+	}
+
+	if requester != "" {
+		if file.KeyEnvelope, err = getKeyEnvelope(file.ID.Hex(), requester); err != nil {
+			return UploadedFile{}, err
+		}
+	}
+
+	if file, err = ResolveFileContent(file); err != nil {
+		return UploadedFile{}, err
+	}
+
+	if !file.InStoragePool && file.ObjectKey != "" && objectStore != nil {
+		if file.DownloadURL, err = objectStore.PresignGet(file.ObjectKey, OBJECT_URL_EXPIRY); err != nil {
+			return UploadedFile{}, err
+		}
+	}
+
+	return file, nil
+}
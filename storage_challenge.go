@@ -0,0 +1,17 @@
+package main
+
+// StorageChallenge asks a host to prove that it still holds a shard by returning one of
+// the shard's chunks, picked at random, along with its Merkle proof.
+type StorageChallenge struct {
+	ID          string `bson:"id" json:"id"`
+	FileID      string `bson:"file_id" json:"file_id"`
+	FileName    string `bson:"file_name" json:"file_name"`
+	ShardIndex  int    `bson:"shard_index" json:"shard_index"`
+	Host        string `bson:"host" json:"host"`
+	LeafIndex   int    `bson:"leaf_index" json:"leaf_index"`
+	Status      string `bson:"status" json:"status"`
+	Reason      string `bson:"reason,omitempty" json:"reason,omitempty"` // why the challenge failed
+	IssuedAt    int64  `bson:"issued_at" json:"issued_at"`               // in unix time
+	Deadline    int64  `bson:"deadline" json:"deadline"`                 // in unix time
+	RespondedAt int64  `bson:"responded_at" json:"responded_at"`         // in unix time
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunChallengeIssuer issues storage challenges every interval. It blocks and is meant to be
+// run in its own goroutine.
+func RunChallengeIssuer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := expireStorageChallenges(); err != nil {
+			log.Println("Unable to expire storage challenges:", err)
+		}
+
+		if issued, err := IssueStorageChallenges(CHALLENGE_FILES_PER_ROUND); err != nil {
+			log.Println("Unable to issue storage challenges:", err)
+		} else if issued > 0 {
+			log.Printf("Issued %v storage challenges\n", issued)
+		}
+		<-ticker.C
+	}
+}
+
+// IssueStorageChallenges picks up to numFiles random storage pool files with registered
+// Merkle roots, and challenges every online holder of one random shard of each. It returns
+// the number of challenges issued.
+func IssueStorageChallenges(numFiles int) (int, error) {
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "in_storage_pool", Value: true},
+			{Key: "shard_merkle_roots.0", Value: bson.D{{Key: "$exists", Value: true}}},
+		}}},
+		bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: numFiles}}}},
+	}
+
+	cursor, err := uploadedFilesColl.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return 0, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, err
+	}
+
+	issued := 0
+	for _, file := range files {
+		shardIndex := rand.Intn(len(file.ShardMerkleRoots))
+		if shardIndex >= len(file.Hosts) || shardIndex >= len(file.ShardLeafCounts) || file.ShardLeafCounts[shardIndex] <= 0 {
+			continue
+		}
+
+		for _, address := range file.Hosts[shardIndex] {
+			if host, err := GetHostByAddress(address); err != nil || host.Status != HOST_ONLINE {
+				continue
+			}
+
+			if _, err := issueStorageChallenge(file, shardIndex, address); err != nil {
+				log.Printf("Unable to challenge %v for shard %v of %v: %v\n", address, shardIndex, file.FileName, err)
+				continue
+			}
+			issued++
+		}
+	}
+
+	return issued, nil
+}
+
+// issueStorageChallenge challenges the host to prove it holds a random chunk of the shard.
+func issueStorageChallenge(file UploadedFile, shardIndex int, host string) (StorageChallenge, error) {
+	now := time.Now()
+	challenge := StorageChallenge{
+		ID:         primitive.NewObjectID().Hex(),
+		FileID:     file.ID.Hex(),
+		FileName:   file.FileName,
+		ShardIndex: shardIndex,
+		Host:       host,
+		LeafIndex:  rand.Intn(file.ShardLeafCounts[shardIndex]),
+		Status:     CHALLENGE_PENDING,
+		IssuedAt:   now.Unix(),
+		Deadline:   now.Add(CHALLENGE_RESPONSE_TIMEOUT).Unix(),
+	}
+
+	if _, err := storageChallengesColl.InsertOne(context.Background(), challenge); err != nil {
+		return StorageChallenge{}, err
+	}
+
+	return challenge, nil
+}
+
+// GetStorageChallenges returns the pending challenges issued to the host.
+func GetStorageChallenges(host string) ([]StorageChallenge, error) {
+	filter := bson.D{
+		{Key: "host", Value: host},
+		{Key: "status", Value: CHALLENGE_PENDING},
+	}
+
+	cursor, err := storageChallengesColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "issued_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	challenges := []StorageChallenge{}
+	if err := cursor.All(context.Background(), &challenges); err != nil {
+		return nil, err
+	}
+
+	return challenges, nil
+}
+
+// RespondToStorageChallenge verifies the chunk and Merkle proof sent by the host against the
+// root registered for the shard, and records whether the challenge was passed.
+func RespondToStorageChallenge(id string, host string, chunk []byte, proof []string) (StorageChallenge, error) {
+	var challenge StorageChallenge
+	if err := storageChallengesColl.FindOne(context.Background(), bson.D{{Key: "id", Value: id}}).Decode(&challenge); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return StorageChallenge{}, fmt.Errorf("storage challenge not found")
+		}
+		return StorageChallenge{}, err
+	}
+
+	if challenge.Host != host {
+		return StorageChallenge{}, fmt.Errorf("storage challenge was issued to another host")
+	}
+	if challenge.Status != CHALLENGE_PENDING {
+		return StorageChallenge{}, fmt.Errorf("storage challenge is already %v", challenge.Status)
+	}
+
+	file, err := getUploadedFileByID(challenge.FileID)
+	if err != nil {
+		return StorageChallenge{}, err
+	}
+
+	status := CHALLENGE_PASSED
+	reason := ""
+	if challenge.ShardIndex >= len(file.ShardMerkleRoots) || challenge.ShardIndex >= len(file.ShardLeafCounts) ||
+		challenge.LeafIndex >= file.ShardLeafCounts[challenge.ShardIndex] {
+		// The file's record has been replaced since the challenge was issued
+		status = CHALLENGE_CANCELLED
+		reason = "shard metadata changed"
+	} else if time.Now().Unix() > challenge.Deadline {
+		status = CHALLENGE_FAILED
+		reason = "response after deadline"
+	} else if err := VerifyMerkleProof(file.ShardMerkleRoots[challenge.ShardIndex], file.ShardLeafCounts[challenge.ShardIndex], challenge.LeafIndex, chunk, proof); err != nil {
+		status = CHALLENGE_FAILED
+		reason = err.Error()
+	}
+
+	return resolveStorageChallenge(challenge, file, status, reason)
+}
+
+// resolveStorageChallenge records the challenge's outcome and the host's pass/fail count.
+// A failed challenge means the host can no longer be trusted with the shard, so a repair
+// replacing it is planned. A cancelled challenge counts for nothing.
+func resolveStorageChallenge(challenge StorageChallenge, file UploadedFile, status string, reason string) (StorageChallenge, error) {
+	challenge.Status = status
+	challenge.Reason = reason
+	challenge.RespondedAt = time.Now().Unix()
+
+	filter := bson.D{{Key: "id", Value: challenge.ID}, {Key: "status", Value: CHALLENGE_PENDING}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: challenge.Status},
+		{Key: "reason", Value: challenge.Reason},
+		{Key: "responded_at", Value: challenge.RespondedAt},
+	}}}
+	if result, err := storageChallengesColl.UpdateOne(context.Background(), filter, update); err != nil {
+		return StorageChallenge{}, err
+	} else if result.ModifiedCount == 0 {
+		return StorageChallenge{}, fmt.Errorf("storage challenge was already resolved")
+	}
+
+	if status == CHALLENGE_FAILED {
+		incrementHostCounter(challenge.Host, "challenges_failed")
+	} else if status == CHALLENGE_PASSED {
+		incrementHostCounter(challenge.Host, "challenges_passed")
+	}
+
+	if status == CHALLENGE_FAILED {
+		if job, created, err := PlanShardRepair(file, challenge.ShardIndex, challenge.Host, "failed storage challenge: "+reason); err != nil {
+			log.Printf("Unable to plan repair after failed challenge %v: %v\n", challenge.ID, err)
+		} else if err := confirmCorruptionReports(challenge, job, created); err != nil {
+			log.Printf("Unable to confirm corruption reports of challenge %v: %v\n", challenge.ID, err)
+		}
+	}
+
+	return challenge, nil
+}
+
+// expireStorageChallenges fails the pending challenges whose deadline has passed.
+func expireStorageChallenges() error {
+	filter := bson.D{
+		{Key: "status", Value: CHALLENGE_PENDING},
+		{Key: "deadline", Value: bson.D{{Key: "$lt", Value: time.Now().Unix()}}},
+	}
+
+	cursor, err := storageChallengesColl.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+
+	var expired []StorageChallenge
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		return err
+	}
+
+	for _, challenge := range expired {
+		file, err := getUploadedFileByID(challenge.FileID)
+		if err != nil {
+			// The file was deleted, so there is nothing left to prove
+			storageChallengesColl.DeleteOne(context.Background(), bson.D{{Key: "id", Value: challenge.ID}})
+			continue
+		}
+
+		if _, err := resolveStorageChallenge(challenge, file, CHALLENGE_FAILED, "no response before deadline"); err != nil {
+			log.Printf("Unable to expire storage challenge %v: %v\n", challenge.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunCreditAccrual settles the monthly subscribers' credits every interval. It blocks and
+// is meant to be run in its own goroutine.
+func RunCreditAccrual(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := SettleCredits(time.Now().Unix()); err != nil {
+			log.Println("Unable to settle storage credits:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// SettleCredits works out, for the time since the last settlement, how many GB-hours of
+// other users' shards each monthly subscriber hosted and how many GB-hours of storage pool
+// space they used themselves. Hosting earns credits and usage spends them, without taking
+// the balance below zero. Hosts only earn for the part of the period they were online, and
+// shards whose host failed a storage challenge during the period earn nothing. The ledger
+// entries, balances and settlement marker are written in one transaction, so a settlement
+// that fails partway can simply be run again.
+func SettleCredits(now int64) error {
+	periodStart, err := lastCreditSettlement()
+	if err != nil {
+		return err
+	}
+	if periodStart == 0 || now-periodStart > int64(CREDITS_MAX_SETTLEMENT_PERIOD.Seconds()) {
+		periodStart = now - int64(CREDITS_SETTLEMENT_INTERVAL.Seconds())
+	}
+	if periodStart >= now {
+		return nil
+	}
+	hours := float64(now-periodStart) / (60 * 60)
+
+	monthlySubs, err := getUsersByAccountType(MONTHLY_SUB)
+	if err != nil {
+		return err
+	}
+	if len(monthlySubs) == 0 {
+		return nil
+	}
+
+	hostedGBHours, err := hostedGBHours(periodStart, now, hours, monthlySubs)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(context.Background(), func(sc mongo.SessionContext) (interface{}, error) {
+		for username, user := range monthlySubs {
+			earned := hostedGBHours[username] * CREDITS_PER_HOSTED_GB_HOUR
+			usedGBHours := user.SpoolCapacityUsed * hours
+			spent := creditsSpent(user.Credits, earned, usedGBHours)
+
+			var entries []interface{}
+			if earned > 0 {
+				entries = append(entries, newCreditLedgerEntry(username, CREDIT_HOSTING, hostedGBHours[username], earned, periodStart, now))
+			}
+			if spent > 0 {
+				entries = append(entries, newCreditLedgerEntry(username, CREDIT_USAGE, usedGBHours, -spent, periodStart, now))
+			}
+			if len(entries) == 0 {
+				continue
+			}
+
+			if _, err := creditLedgerColl.InsertMany(sc, entries); err != nil {
+				return nil, err
+			}
+
+			update := bson.D{{Key: "$inc", Value: bson.D{{Key: "credits", Value: earned - spent}}}}
+			if _, err := userDetailsColl.UpdateOne(sc, bson.D{{Key: "user_name", Value: username}}, update); err != nil {
+				return nil, err
+			}
+		}
+
+		// Record the settlement even if nobody earned or spent anything, so the next period starts here
+		marker := newCreditLedgerEntry("", CREDIT_SETTLEMENT, 0, 0, periodStart, now)
+		if _, err := creditLedgerColl.InsertOne(sc, marker); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// creditsSpent returns the credits spent on usedGBHours of storage pool usage by a user
+// with the given balance who earned the given credits in the same period. The balance does
+// not go below zero.
+func creditsSpent(balance float64, earned float64, usedGBHours float64) float64 {
+	return math.Max(0, math.Min(balance+earned, usedGBHours*CREDITS_PER_USED_GB_HOUR))
+}
+
+// hostOnlineShare returns the share of the period (0-1) a host whose last heartbeat was at
+// lastHeartbeat was online for. A host counts as online until HOST_STALE_AFTER has passed
+// since its last heartbeat. Only the last heartbeat is known, so a host that came back
+// during the period counts as online from its start.
+func hostOnlineShare(lastHeartbeat int64, periodStart int64, periodEnd int64) float64 {
+	if periodEnd <= periodStart {
+		return 0
+	}
+
+	onlineUntil := lastHeartbeat + int64(HOST_STALE_AFTER.Seconds())
+	if onlineUntil >= periodEnd {
+		return 1
+	}
+	if onlineUntil <= periodStart {
+		return 0
+	}
+
+	return float64(onlineUntil-periodStart) / float64(periodEnd-periodStart)
+}
+
+// hostedGBHours returns the GB-hours of other users' shards each of the given users hosted
+// during the period, for the part of it their host was online.
+func hostedGBHours(periodStart int64, periodEnd int64, hours float64, users map[string]User) (map[string]float64, error) {
+	hosts, err := GetHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	hostUsers := make(map[string]string)
+	onlineShares := make(map[string]float64)
+	for _, host := range hosts {
+		if _, ok := users[host.UserName]; ok {
+			hostUsers[host.Address] = host.UserName
+			onlineShares[host.Address] = hostOnlineShare(host.LastHeartbeat, periodStart, periodEnd)
+		}
+	}
+
+	failed, err := failedChallengesDuring(periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := uploadedFilesColl.Find(context.Background(), bson.D{{Key: "in_storage_pool", Value: true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	gbHours := make(map[string]float64)
+	for cursor.Next(context.Background()) {
+		var file UploadedFile
+		if err := cursor.Decode(&file); err != nil {
+			return nil, err
+		}
+
+		for shardIndex, shardHosts := range file.Hosts {
+			for _, address := range shardHosts {
+				username, ok := hostUsers[address]
+				if !ok || username == file.UploaderUsername || failed[challengeKey(file.ID.Hex(), shardIndex, address)] {
+					continue
+				}
+
+				gbHours[username] += file.ShardSize() * hours * onlineShares[address]
+			}
+		}
+	}
+
+	return gbHours, cursor.Err()
+}
+
+// failedChallengesDuring returns the file, shard and host of every storage challenge that
+// failed during the period, keyed by challengeKey.
+func failedChallengesDuring(periodStart int64, periodEnd int64) (map[string]bool, error) {
+	filter := bson.D{
+		{Key: "status", Value: CHALLENGE_FAILED},
+		{Key: "responded_at", Value: bson.D{{Key: "$gte", Value: periodStart}, {Key: "$lte", Value: periodEnd}}},
+	}
+
+	cursor, err := storageChallengesColl.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var challenges []StorageChallenge
+	if err := cursor.All(context.Background(), &challenges); err != nil {
+		return nil, err
+	}
+
+	failed := make(map[string]bool)
+	for _, challenge := range challenges {
+		failed[challengeKey(challenge.FileID, challenge.ShardIndex, challenge.Host)] = true
+	}
+
+	return failed, nil
+}
+
+// challengeKey identifies a shard held by a host.
+func challengeKey(fileID string, shardIndex int, host string) string {
+	return fmt.Sprintf("%v:%v:%v", fileID, shardIndex, host)
+}
+
+// lastCreditSettlement returns the end of the last settled period, or 0 if credits have
+// never been settled.
+func lastCreditSettlement() (int64, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "period_end", Value: -1}})
+
+	var entry CreditLedgerEntry
+	if err := creditLedgerColl.FindOne(context.Background(), bson.D{}, opts).Decode(&entry); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return entry.PeriodEnd, nil
+}
+
+// GetCreditLedger returns the user's most recent credit ledger entries, newest first.
+func GetCreditLedger(username string, limit int64) ([]CreditLedgerEntry, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "period_end", Value: -1}}).SetLimit(limit)
+
+	cursor, err := creditLedgerColl.Find(context.Background(), bson.D{{Key: "user_name", Value: username}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CreditLedgerEntry{}
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// getUsersByAccountType returns the users with the given account type, keyed by username.
+func getUsersByAccountType(accountType string) (map[string]User, error) {
+	cursor, err := userDetailsColl.Find(context.Background(), bson.D{{Key: "account_type", Value: accountType}})
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		return nil, err
+	}
+
+	byUsername := make(map[string]User)
+	for _, user := range users {
+		byUsername[user.UserName] = user
+	}
+
+	return byUsername, nil
+}
+
+func newCreditLedgerEntry(username string, kind string, gbHours float64, amount float64, periodStart int64, periodEnd int64) CreditLedgerEntry {
+	return CreditLedgerEntry{
+		ID:          primitive.NewObjectID().Hex(),
+		UserName:    username,
+		Kind:        kind,
+		GBHours:     gbHours,
+		Amount:      amount,
+		PeriodStart: periodStart,
+		PeriodEnd:   periodEnd,
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestHostOnlineShare(t *testing.T) {
+	stale := int64(HOST_STALE_AFTER.Seconds())
+
+	tests := []struct {
+		name          string
+		lastHeartbeat int64
+		periodStart   int64
+		periodEnd     int64
+		want          float64
+	}{
+		{"online throughout", 10000, 6400, 10000, 1},
+		{"stale but not past the period end", 10000 - stale, 6400, 10000, 1},
+		{"went offline halfway", 8200 - stale, 6400, 10000, 0.5},
+		{"offline before the period", 6400 - stale, 6400, 10000, 0},
+		{"dead long before", 0, 6400, 10000, 0},
+		{"empty period", 10000, 10000, 10000, 0},
+	}
+
+	for _, test := range tests {
+		if got := hostOnlineShare(test.lastHeartbeat, test.periodStart, test.periodEnd); !near(got, test.want) {
+			t.Errorf("%v: hostOnlineShare() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCreditsSpent(t *testing.T) {
+	tests := []struct {
+		name        string
+		balance     float64
+		earned      float64
+		usedGBHours float64
+		want        float64
+	}{
+		{"covered by the balance", 100, 0, 10, 10 * CREDITS_PER_USED_GB_HOUR},
+		{"covered by what was earned", 0, 50, 10, 10 * CREDITS_PER_USED_GB_HOUR},
+		{"capped at the balance and earnings", 3, 2, 10, 5},
+		{"nothing left to spend", 0, 0, 10, 0},
+		{"nothing used", 100, 10, 0, 0},
+	}
+
+	for _, test := range tests {
+		if got := creditsSpent(test.balance, test.earned, test.usedGBHours); !near(got, test.want) {
+			t.Errorf("%v: creditsSpent() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+// StorePlacement tells an uploading node where to store a file. For the storage pool,
+// Placement holds one list of host addresses per shard (data shards first, then backup
+// shards); no host appears in more than one list.
+type StorePlacement struct {
+	Location  string     `json:"location"`
+	ShardSize float64    `json:"shard_size"` // in gigabytes
+	Placement [][]string `json:"placement"`
+
+	// Answering the challenge when recording the file with /file proves the node holds the
+	// content, so that it is not uploaded again if it is already stored
+	DedupChallenge *DedupChallenge `json:"dedup_challenge,omitempty"`
+
+	// For the AWS tier, when the server manages the object store: the key to record the
+	// file with and the pre-signed URL to upload it to before UploadURLExpiresAt
+	ObjectKey          string `json:"object_key,omitempty"`
+	UploadURL          string `json:"upload_url,omitempty"`
+	UploadURLExpiresAt int64  `json:"upload_url_expires_at,omitempty"` // in unix time
+
+	// Availability is the estimated chance of the file being retrievable through the day
+	Availability *FileAvailability `json:"availability,omitempty"`
+}
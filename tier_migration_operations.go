@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunMigrationPlanner plans tier migrations every interval.
+func RunMigrationPlanner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if planned, err := PlanMigrations(); err != nil {
+			log.Println("Unable to plan tier migrations:", err)
+		} else if planned > 0 {
+			log.Printf("Planned %v tier migrations\n", planned)
+		}
+		<-ticker.C
+	}
+}
+
+// PlanMigrations keeps the storage pool's utilisation between the low and high water
+// marks. Above the high water mark, monthly subscribers' files are moved out to AWS to make
+// room for the fixed amount customers the pool is meant for. Below the low water mark,
+// fixed amount customers' files that had to go to AWS are brought back to the pool. Either
+// way files are moved until the pool would be at its target utilisation, counting the
+// migrations already in progress. It returns the number of migrations planned.
+func PlanMigrations() (int, error) {
+	if err := failTimedOutMigrationJobs(); err != nil {
+		log.Println("Unable to fail timed out migration jobs:", err)
+	}
+
+	var state NetworkStorageState
+	if err := findNetworkStateInMongo(&state); err != nil {
+		return 0, err
+	}
+	if state.TotalStoragePoolSize <= 0 {
+		return 0, nil
+	}
+
+	pending, err := GetMigrationJobs("", MIGRATION_PENDING)
+	if err != nil {
+		return 0, err
+	}
+
+	used := state.TotalStoragePoolUsed
+	migrating := bson.A{}
+	for _, job := range pending {
+		if job.ToTier == "spool" {
+			used += job.FileSize
+		} else {
+			used -= job.FileSize
+		}
+
+		if fileID, err := primitive.ObjectIDFromHex(job.FileID); err == nil {
+			migrating = append(migrating, fileID)
+		}
+	}
+
+	target := MIGRATION_SPOOL_TARGET * state.TotalStoragePoolSize
+	switch utilisation := used / state.TotalStoragePoolSize; {
+	case utilisation > MIGRATION_SPOOL_HIGH_WATER:
+		return planMigrationsToAws(used-target, migrating)
+	case utilisation < MIGRATION_SPOOL_LOW_WATER:
+		return planMigrationsToSpool(target-used, migrating)
+	default:
+		return 0, nil
+	}
+}
+
+// migrationCandidates returns up to MIGRATION_JOBS_PER_ROUND files in the given tier that
+// can be migrated: they hold their own content (deduplicated content stays where it is),
+// are not in the trash and are not already being migrated.
+func migrationCandidates(inStoragePool bool, isMonthlySub bool, migrating bson.A, sort bson.D) ([]UploadedFile, error) {
+	filter := bson.D{
+		{Key: "in_storage_pool", Value: inStoragePool},
+		{Key: "is_monthly_sub", Value: isMonthlySub},
+		{Key: "is_reference", Value: bson.D{{Key: "$ne", Value: true}}},
+		{Key: "ref_count", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: 1}}}}},
+		{Key: "_id", Value: bson.D{{Key: "$nin", Value: migrating}}},
+		notTrashed(),
+	}
+
+	opts := options.Find().SetSort(sort).SetLimit(MIGRATION_JOBS_PER_ROUND)
+	cursor, err := uploadedFilesColl.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// planMigrationsToAws moves monthly subscribers' files, largest first, out of the storage
+// pool until at least excess gigabytes would be freed.
+func planMigrationsToAws(excess float64, migrating bson.A) (int, error) {
+	files, err := migrationCandidates(true, true, migrating, bson.D{{Key: "file_size", Value: -1}})
+	if err != nil {
+		return 0, err
+	}
+
+	planned := 0
+	for _, file := range files {
+		if excess <= 0 {
+			break
+		}
+
+		if err := insertMigrationJob(file, "spool", "aws", nil, "storage pool above high water mark"); err != nil {
+			return planned, err
+		}
+		excess -= file.FileSize
+		planned++
+	}
+
+	return planned, nil
+}
+
+// planMigrationsToSpool brings fixed amount customers' files, oldest first, back into the
+// storage pool while they fit in room gigabytes and hosts can be found for their shards.
+func planMigrationsToSpool(room float64, migrating bson.A) (int, error) {
+	files, err := migrationCandidates(false, false, migrating, bson.D{{Key: "upload_date", Value: 1}})
+	if err != nil {
+		return 0, err
+	}
+
+	planned := 0
+	for _, file := range files {
+		if file.FileSize > room {
+			continue
+		}
+
+		numShards := file.Shards + file.BackupShards
+		if numShards <= 0 {
+			numShards = 1
+		}
+
+		// The space is reserved on the hosts, so later placements cannot overcommit them
+		placement, err := SelectShardHosts(numShards, STORE_DEFAULT_REPLICAS, file.FileSize/float64(numShards), file.UploaderUsername)
+		if err != nil {
+			log.Printf("Unable to place shards of %v for migration to the storage pool: %v\n", file.FileName, err)
+			continue
+		}
+
+		if err := insertMigrationJob(file, "aws", "spool", placement, "storage pool below low water mark"); err != nil {
+			releaseHostSpace(placement, file.FileSize/float64(numShards))
+			return planned, err
+		}
+		room -= file.FileSize
+		planned++
+	}
+
+	return planned, nil
+}
+
+// insertMigrationJob records a pending migration of the file.
+func insertMigrationJob(file UploadedFile, fromTier string, toTier string, placement [][]string, reason string) error {
+	now := time.Now().Unix()
+	job := MigrationJob{
+		ID:        primitive.NewObjectID().Hex(),
+		FileID:    file.ID.Hex(),
+		FileName:  file.FileName,
+		Folder:    CleanFolderPath(file.Folder),
+		Owner:     file.UploaderUsername,
+		FromTier:  fromTier,
+		ToTier:    toTier,
+		FileSize:  file.FileSize,
+		Placement: placement,
+		Reason:    reason,
+		Status:    MIGRATION_PENDING,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if fromTier == "aws" {
+		job.ObjectKey = file.ObjectKey
+	} else if objectStore != nil {
+		job.ObjectKey = newObjectKey(file.UploaderUsername)
+	}
+
+	_, err := migrationJobsColl.InsertOne(context.Background(), job)
+	return err
+}
+
+// GetMigrationJobs returns the migration jobs of the owner's files (every owner's if
+// empty) with the given status (any status if empty), oldest first. When listing one
+// owner's jobs, the pending ones with an object key come with a pre-signed URL for the
+// object; the listing of every owner's jobs never includes them.
+func GetMigrationJobs(owner string, status string) ([]MigrationJob, error) {
+	filter := bson.D{}
+	if owner != "" {
+		filter = append(filter, bson.E{Key: "owner", Value: owner})
+	}
+	if status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+
+	cursor, err := migrationJobsColl.Find(context.Background(), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []MigrationJob{}
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return nil, err
+	}
+
+	if owner == "" || objectStore == nil {
+		return jobs, nil
+	}
+
+	for i, job := range jobs {
+		if job.Status != MIGRATION_PENDING || job.ObjectKey == "" || job.Owner != owner {
+			continue
+		}
+
+		presign := objectStore.PresignPut
+		if job.FromTier == "aws" {
+			presign = objectStore.PresignGet
+		}
+		if jobs[i].ObjectURL, err = presign(job.ObjectKey, OBJECT_URL_EXPIRY); err != nil {
+			return nil, err
+		}
+	}
+
+	return jobs, nil
+}
+
+// CompleteMigrationJob records the outcome of a migration reported by the owner's node. On
+// success the file's tier and hosts, the owner's usage and the network's used capacity are
+// all switched over in one transaction, and the old hosts are asked to purge their shards.
+func CompleteMigrationJob(id string, owner string, success bool) (MigrationJob, error) {
+	var job MigrationJob
+	if err := migrationJobsColl.FindOne(context.Background(), bson.D{{Key: "id", Value: id}}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return MigrationJob{}, fmt.Errorf("migration job not found")
+		}
+		return MigrationJob{}, err
+	}
+
+	if job.Owner != owner {
+		return MigrationJob{}, fmt.Errorf("migration job belongs to another user")
+	}
+	if job.Status != MIGRATION_PENDING {
+		return MigrationJob{}, fmt.Errorf("migration job is already %v", job.Status)
+	}
+
+	if !success {
+		return failMigrationJob(job)
+	}
+
+	file, err := getUploadedFileByID(job.FileID)
+	if err != nil {
+		failMigrationJob(job)
+		return MigrationJob{}, err
+	}
+
+	if err := switchFileTier(job); err != nil {
+		failMigrationJob(job)
+		return MigrationJob{}, err
+	}
+	job.Status = MIGRATION_COMPLETED
+
+	notifyNetworkStateChanged()
+	go evaluateUserAlertsInBackground(job.Owner)
+
+	if job.FromTier == "spool" {
+		if err := PlanShardPurges(file, "file migrated to aws"); err != nil {
+			log.Println("Unable to ask hosts to purge migrated shards:", err)
+		}
+	} else {
+		deleteStoredObject(file.ObjectKey)
+	}
+
+	return job, nil
+}
+
+// switchFileTier moves the file of a completed migration job to its new tier, along with
+// the owner's and the network's used capacity, and marks the job completed. A file leaving
+// the storage pool has its pending storage challenges and repairs cancelled, since its old
+// hosts are about to purge the shards.
+func switchFileTier(job MigrationJob) error {
+	fileID, err := primitive.ObjectIDFromHex(job.FileID)
+	if err != nil {
+		return err
+	}
+
+	toSpool := job.ToTier == "spool"
+	spoolDelta, awsDelta := migrationCapacityDeltas(job)
+
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(context.Background(), func(sc mongo.SessionContext) (interface{}, error) {
+		fileFilter := bson.D{{Key: "_id", Value: fileID}, {Key: "in_storage_pool", Value: !toSpool}}
+		fileSet := bson.D{
+			{Key: "in_storage_pool", Value: toSpool},
+			{Key: "hosts", Value: job.Placement},
+		}
+		fileUpdate := bson.D{{Key: "$unset", Value: bson.D{{Key: "object_key", Value: ""}}}}
+		if !toSpool && job.ObjectKey != "" {
+			fileSet = append(fileSet, bson.E{Key: "object_key", Value: job.ObjectKey})
+			fileUpdate = bson.D{}
+		}
+		fileUpdate = append(fileUpdate, bson.E{Key: "$set", Value: fileSet})
+		if result, err := uploadedFilesColl.UpdateOne(sc, fileFilter, fileUpdate); err != nil {
+			return nil, err
+		} else if result.MatchedCount == 0 {
+			return nil, fmt.Errorf("file is no longer in the %v tier", job.FromTier)
+		}
+
+		userUpdate := bson.D{{Key: "$inc", Value: bson.D{
+			{Key: "spool_capacity_used", Value: spoolDelta},
+			{Key: "aws_capacity_used", Value: awsDelta},
+		}}}
+		if _, err := userDetailsColl.UpdateOne(sc, bson.D{{Key: "user_name", Value: job.Owner}}, userUpdate); err != nil {
+			return nil, err
+		}
+
+		networkUpdate := bson.D{{Key: "$inc", Value: bson.D{
+			{Key: "total_storage_pool_used", Value: spoolDelta},
+			{Key: "total_aws_storage_used", Value: awsDelta},
+		}}}
+		if _, err := storageCapacityColl.UpdateOne(sc, filter, networkUpdate); err != nil {
+			return nil, err
+		}
+
+		if !toSpool {
+			pending := bson.D{{Key: "file_id", Value: job.FileID}, {Key: "status", Value: CHALLENGE_PENDING}}
+			cancel := bson.D{{Key: "$set", Value: bson.D{
+				{Key: "status", Value: CHALLENGE_CANCELLED},
+				{Key: "reason", Value: "file migrated to aws"},
+				{Key: "responded_at", Value: time.Now().Unix()},
+			}}}
+			if _, err := storageChallengesColl.UpdateMany(sc, pending, cancel); err != nil {
+				return nil, err
+			}
+
+			pending = bson.D{{Key: "file_id", Value: job.FileID}, {Key: "status", Value: REPAIR_PENDING}}
+			cancel = bson.D{{Key: "$set", Value: bson.D{
+				{Key: "status", Value: REPAIR_CANCELLED},
+				{Key: "updated_at", Value: time.Now().Unix()},
+			}}}
+			if _, err := repairJobsColl.UpdateMany(sc, pending, cancel); err != nil {
+				return nil, err
+			}
+		}
+
+		jobUpdate := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: MIGRATION_COMPLETED},
+			{Key: "updated_at", Value: time.Now().Unix()},
+		}}}
+		if _, err := migrationJobsColl.UpdateOne(sc, bson.D{{Key: "id", Value: job.ID}}, jobUpdate); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// migrationCapacityDeltas returns how much the job moves the storage pool and AWS used
+// capacity by when it completes.
+func migrationCapacityDeltas(job MigrationJob) (spoolDelta float64, awsDelta float64) {
+	if job.ToTier == "spool" {
+		return job.FileSize, -job.FileSize
+	}
+
+	return -job.FileSize, job.FileSize
+}
+
+// migrationShardSize returns the size (in gigabytes) of each shard placed for the job, as
+// reserved on their hosts when the job was planned.
+func migrationShardSize(job MigrationJob) float64 {
+	if len(job.Placement) == 0 {
+		return 0
+	}
+
+	return job.FileSize / float64(len(job.Placement))
+}
+
+// failMigrationJob marks the pending job failed. The space reserved on the hosts of a
+// migration to the storage pool is given back, since the shards will not be stored.
+func failMigrationJob(job MigrationJob) (MigrationJob, error) {
+	job.Status = MIGRATION_FAILED
+	job.UpdatedAt = time.Now().Unix()
+
+	filter := bson.D{{Key: "id", Value: job.ID}, {Key: "status", Value: MIGRATION_PENDING}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: job.Status},
+		{Key: "updated_at", Value: job.UpdatedAt},
+	}}}
+	result, err := migrationJobsColl.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return MigrationJob{}, err
+	}
+
+	// Only whoever failed the job gives the space back
+	if result.ModifiedCount > 0 && job.ToTier == "spool" {
+		releaseHostSpace(job.Placement, migrationShardSize(job))
+	}
+
+	return job, nil
+}
+
+// failTimedOutMigrationJobs fails the pending migrations that have not completed in time,
+// so that the files can be considered again.
+func failTimedOutMigrationJobs() error {
+	filter := bson.D{
+		{Key: "status", Value: MIGRATION_PENDING},
+		{Key: "created_at", Value: bson.D{{Key: "$lt", Value: time.Now().Add(-MIGRATION_JOB_TIMEOUT).Unix()}}},
+	}
+
+	cursor, err := migrationJobsColl.Find(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+
+	var jobs []MigrationJob
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if _, err := failMigrationJob(job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
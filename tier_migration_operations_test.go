@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestMigrationCapacityDeltas(t *testing.T) {
+	tests := []struct {
+		name      string
+		job       MigrationJob
+		wantSpool float64
+		wantAws   float64
+	}{
+		{"to the storage pool", MigrationJob{FromTier: "aws", ToTier: "spool", FileSize: 2}, 2, -2},
+		{"to aws", MigrationJob{FromTier: "spool", ToTier: "aws", FileSize: 3}, -3, 3},
+	}
+
+	for _, test := range tests {
+		spool, aws := migrationCapacityDeltas(test.job)
+		if spool != test.wantSpool || aws != test.wantAws {
+			t.Errorf("%v: migrationCapacityDeltas() = %v, %v, want %v, %v", test.name, spool, aws, test.wantSpool, test.wantAws)
+		}
+	}
+}
+
+func TestMigrationShardSize(t *testing.T) {
+	tests := []struct {
+		name string
+		job  MigrationJob
+		want float64
+	}{
+		{"one shard", MigrationJob{FileSize: 2, Placement: [][]string{{"a"}}}, 2},
+		{"replicated shards", MigrationJob{FileSize: 3, Placement: [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}}}, 1},
+		{"no placement", MigrationJob{FileSize: 3}, 0},
+	}
+
+	for _, test := range tests {
+		if got := migrationShardSize(test.job); !near(got, test.want) {
+			t.Errorf("%v: migrationShardSize() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deleted files are moved to the trash rather than deleted straight away. They keep
+// counting against the user's quota and their hosts keep their shards until the trash
+// is purged, so they can be restored within the trash retention period.
+
+// trashRetention is how long files stay in the trash before they are deleted for good.
+var trashRetention = envDuration("SHR_TRASH_RETENTION", TRASH_RETENTION)
+
+// notTrashed matches the files that are not in the trash.
+func notTrashed() bson.E {
+	return bson.E{Key: "trashed_at", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: 0}}}}}
+}
+
+// TrashFile moves every version of the user's file to the trash.
+func TrashFile(username string, folder string, fileName string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "trashed_at", Value: time.Now().Unix()}}}}
+	if result, err := uploadedFilesColl.UpdateMany(context.Background(), fileFilter(username, folder, fileName), update); err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return fmt.Errorf("file not found")
+	}
+
+	return nil
+}
+
+// GetTrash returns the files in the user's trash, most recently trashed first.
+func GetTrash(username string) ([]TrashedFile, error) {
+	filter := bson.D{
+		{Key: "uploader_username", Value: username},
+		{Key: "trashed_at", Value: bson.D{{Key: "$gt", Value: 0}}},
+	}
+
+	cursor, err := uploadedFilesColl.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return nil, err
+	}
+
+	return groupTrashedFiles(files, trashRetention), nil
+}
+
+// groupTrashedFiles lists the trashed file versions once per file, most recently trashed
+// first. A file is purged once its earliest trashed version has been in the trash for the
+// retention period.
+func groupTrashedFiles(files []UploadedFile, retention time.Duration) []TrashedFile {
+	// A trashed file is listed once however many versions it has
+	trashed := make(map[string]*TrashedFile)
+	for _, file := range files {
+		key := CleanFolderPath(file.Folder) + "\x00" + file.FileName
+		entry, ok := trashed[key]
+		if !ok {
+			entry = &TrashedFile{
+				FileName:  file.FileName,
+				Folder:    CleanFolderPath(file.Folder),
+				TrashedAt: file.TrashedAt,
+				PurgeAt:   file.TrashedAt + int64(retention.Seconds()),
+			}
+			trashed[key] = entry
+		}
+
+		entry.Versions++
+		entry.FileSize += file.FileSize
+		if file.TrashedAt < entry.TrashedAt {
+			entry.TrashedAt = file.TrashedAt
+			entry.PurgeAt = file.TrashedAt + int64(retention.Seconds())
+		}
+	}
+
+	result := make([]TrashedFile, 0, len(trashed))
+	for _, entry := range trashed {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].TrashedAt > result[j].TrashedAt
+	})
+
+	return result
+}
+
+// RestoreFile moves the versions of the user's file that were trashed last out of the
+// trash, as long as they were trashed within the trash retention period. Versions from
+// earlier trashes of the same name stay in the trash. It fails if the user has since
+// recorded another file with the same folder and name.
+func RestoreFile(username string, folder string, fileName string) error {
+	if existing, err := GetFileVersions(username, folder, fileName); err != nil {
+		return err
+	} else if len(existing) > 0 {
+		return fmt.Errorf("a file named %v already exists in %v", fileName, CleanFolderPath(folder))
+	}
+
+	if err := EnsureFolder(username, folder); err != nil {
+		return err
+	}
+
+	filter := bson.D{
+		{Key: "uploader_username", Value: username},
+		folderMatch(CleanFolderPath(folder)),
+		{Key: "file_name", Value: fileName},
+		{Key: "trashed_at", Value: bson.D{{Key: "$gt", Value: time.Now().Add(-trashRetention).Unix()}}},
+	}
+
+	// TrashFile trashes every version at once, so the last trash is the versions with the
+	// newest trashed_at
+	var newest UploadedFile
+	opts := options.FindOne().SetSort(bson.D{{Key: "trashed_at", Value: -1}})
+	if err := uploadedFilesColl.FindOne(context.Background(), filter, opts).Decode(&newest); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("file not found in the trash")
+		}
+		return err
+	}
+
+	filter = bson.D{
+		{Key: "uploader_username", Value: username},
+		folderMatch(CleanFolderPath(folder)),
+		{Key: "file_name", Value: fileName},
+		{Key: "trashed_at", Value: newest.TrashedAt},
+	}
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "trashed_at", Value: ""}}}}
+	if _, err := uploadedFilesColl.UpdateMany(context.Background(), filter, update); err != nil {
+		return err
+	}
+
+	return resetLatestFileVersion(username, folder, fileName)
+}
+
+// RunTrashPurger permanently deletes the files that have been in the trash for longer than
+// the trash retention period, every interval.
+func RunTrashPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if purged, err := PurgeTrash(time.Now().Add(-trashRetention).Unix()); err != nil {
+			log.Println("Unable to purge the trash:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %v files from the trash\n", purged)
+		}
+		<-ticker.C
+	}
+}
+
+// PurgeTrash permanently deletes the file versions trashed before the cutoff, reversing
+// their capacity accounting and asking their hosts to purge the shards. It returns the
+// number of file records deleted.
+func PurgeTrash(cutoff int64) (int, error) {
+	filter := bson.D{{Key: "trashed_at", Value: bson.D{{Key: "$gt", Value: 0}, {Key: "$lte", Value: cutoff}}}}
+
+	cursor, err := uploadedFilesColl.Find(context.Background(), filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var files []UploadedFile
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, file := range files {
+		file, found, err := reloadUploadedFile(file)
+		if err != nil {
+			return purged, err
+		} else if !found {
+			continue
+		}
+
+		if err := RemoveUploadedFile(file); err != nil {
+			return purged, err
+		}
+		purged++
+
+		// The grants of the file go once nothing is left of it
+		remaining, err := uploadedFilesColl.CountDocuments(context.Background(), bson.D{
+			{Key: "uploader_username", Value: file.UploaderUsername},
+			folderMatch(CleanFolderPath(file.Folder)),
+			{Key: "file_name", Value: file.FileName},
+		})
+		if err != nil {
+			return purged, err
+		}
+		if remaining == 0 {
+			if err := deleteShareGrants(file.UploaderUsername, file.Folder, file.FileName); err != nil {
+				return purged, err
+			}
+		}
+	}
+
+	return purged, nil
+}
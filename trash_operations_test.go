@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupTrashedFiles(t *testing.T) {
+	retention := 10 * time.Second
+
+	files := []UploadedFile{
+		{FileName: "a.txt", Folder: "/docs", FileSize: 1, Version: 1, TrashedAt: 100},
+		{FileName: "a.txt", Folder: "/docs/", FileSize: 2, Version: 2, TrashedAt: 100},
+		{FileName: "a.txt", Folder: "/docs", FileSize: 4, Version: 3, TrashedAt: 300},
+		{FileName: "a.txt", Folder: "/", FileSize: 8, Version: 1, TrashedAt: 200},
+		{FileName: "b.txt", Folder: "", FileSize: 16, TrashedAt: 400},
+	}
+
+	want := []TrashedFile{
+		{FileName: "b.txt", Folder: "/", Versions: 1, FileSize: 16, TrashedAt: 400, PurgeAt: 410},
+		{FileName: "a.txt", Folder: "/", Versions: 1, FileSize: 8, TrashedAt: 200, PurgeAt: 210},
+		{FileName: "a.txt", Folder: "/docs", Versions: 3, FileSize: 7, TrashedAt: 100, PurgeAt: 110},
+	}
+
+	got := groupTrashedFiles(files, retention)
+	if len(got) != len(want) {
+		t.Fatalf("groupTrashedFiles() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("groupTrashedFiles()[%v] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if got := groupTrashedFiles(nil, retention); len(got) != 0 {
+		t.Errorf("groupTrashedFiles(nil) = %v, want none", got)
+	}
+}
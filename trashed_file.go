@@ -0,0 +1,11 @@
+package main
+
+// TrashedFile is a file in a user's trash, with all of its trashed versions.
+type TrashedFile struct {
+	FileName  string  `json:"file_name"`
+	Folder    string  `json:"folder"`
+	Versions  int     `json:"versions"`
+	FileSize  float64 `json:"file_size"`  // of all the versions, in gigabytes
+	TrashedAt int64   `json:"trashed_at"` // in unix time
+	PurgeAt   int64   `json:"purge_at"`   // in unix time, when the file is deleted for good
+}
@@ -1,14 +1,94 @@
 package main
 
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
 type UploadedFile struct {
-	FileName        string     `json:"file_name"`
-	FileSize        float64      `json:"file_size"`   // in gigabytes
-	UploadDate      int        `json:"upload_date"` // in unix time
-	InStoragePool   bool       `json:"in_storage_pool"`
-	Hosts           [][]string `json:"hosts"`
-	Shards          int        `json:"shards"`
-	UploaderUsername string     `json:"uploader_username"`
-	BackupShards    int        `json:"backup_shards"`
-	IsMonthlySub    bool       `json:"is_monthly_sub"`
-	Timezone        string     `json:"timezone"`
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FileName         string             `bson:"file_name" json:"file_name"`
+	Folder           string             `bson:"folder" json:"folder"`           // e.g. "/photos/2023", see folder_operations.go
+	FileSize         float64            `bson:"file_size" json:"file_size"`     // in gigabytes
+	UploadDate       int                `bson:"upload_date" json:"upload_date"` // in unix time
+	InStoragePool    bool               `bson:"in_storage_pool" json:"in_storage_pool"`
+	Hosts            [][]string         `bson:"hosts" json:"hosts"` // the addresses holding each shard
+	Shards           int                `bson:"shards" json:"shards"`
+	UploaderUsername string             `bson:"uploader_username" json:"uploader_username"`
+	BackupShards     int                `bson:"backup_shards" json:"backup_shards"`
+	IsMonthlySub     bool               `bson:"is_monthly_sub" json:"is_monthly_sub"`
+	Timezone         string             `bson:"timezone" json:"timezone"`
+
+	// Each recording of a file name creates a new version, see file_version_operations.go
+	Version  int  `bson:"version" json:"version"`
+	IsLatest bool `bson:"is_latest" json:"is_latest"`
+
+	ExpiresAt int64 `bson:"expires_at,omitempty" json:"expires_at,omitempty"` // in unix time, 0 for never
+	TrashedAt int64 `bson:"trashed_at,omitempty" json:"trashed_at,omitempty"` // in unix time, see trash_operations.go
+
+	// The object holding the file in the AWS tier when the server manages the object store,
+	// and a pre-signed URL to download it, set when the file is looked up
+	ObjectKey   string `bson:"object_key,omitempty" json:"object_key,omitempty"`
+	DownloadURL string `bson:"-" json:"download_url,omitempty"`
+
+	// The Merkle root (hex) and number of chunks of each shard, used to challenge hosts
+	// to prove they still hold the shards
+	ShardMerkleRoots []string `bson:"shard_merkle_roots,omitempty" json:"shard_merkle_roots,omitempty"`
+	ShardLeafCounts  []int    `bson:"shard_leaf_counts,omitempty" json:"shard_leaf_counts,omitempty"`
+
+	// Integrity metadata letting a downloader verify the shards and the reassembled file
+	FileHash      string         `bson:"file_hash,omitempty" json:"file_hash,omitempty"`
+	ShardHashes   []string       `bson:"shard_hashes,omitempty" json:"shard_hashes,omitempty"`
+	ErasureCoding *ErasureCoding `bson:"erasure_coding,omitempty" json:"erasure_coding,omitempty"`
+
+	// Files with the same content share storage, see file_deduplication_operations.go
+	ContentHash string `bson:"content_hash,omitempty" json:"content_hash,omitempty"`
+	IsReference bool   `bson:"is_reference" json:"is_reference"`
+	RefCount    int    `bson:"ref_count,omitempty" json:"ref_count,omitempty"`
+
+	// The file key wrapped to the requester, set when the file is looked up
+	KeyEnvelope *KeyEnvelope `bson:"-" json:"key_envelope,omitempty"`
+}
+
+// ErasureCoding describes how a file was split into shards, so that a downloader can
+// reassemble it from any DataShards of its shards.
+type ErasureCoding struct {
+	Algorithm    string `bson:"algorithm" json:"algorithm"` // e.g. "reed-solomon"
+	DataShards   int    `bson:"data_shards" json:"data_shards"`
+	ParityShards int    `bson:"parity_shards" json:"parity_shards"`
+	ShardLength  int64  `bson:"shard_length" json:"shard_length"` // in bytes, including padding
+	FileLength   int64  `bson:"file_length" json:"file_length"`   // in bytes, to strip the padding
+}
+
+// ShardSize returns the size of a single shard of the file (in gigabytes).
+func (f UploadedFile) ShardSize() float64 {
+	if f.Shards <= 0 {
+		return f.FileSize
+	}
+
+	return f.FileSize / float64(f.Shards)
+}
+
+// WithoutStorageDetails returns the file without the hosts and shard metadata needed to
+// download it, for requesters who may not read it.
+func (f UploadedFile) WithoutStorageDetails() UploadedFile {
+	f.Hosts = nil
+	f.ShardMerkleRoots = nil
+	f.ShardLeafCounts = nil
+	f.ShardHashes = nil
+	f.ErasureCoding = nil
+	f.KeyEnvelope = nil
+	f.ObjectKey = ""
+	f.DownloadURL = ""
+	return f
+}
+
+// HoldsShard reports whether the address holds any shard of the file.
+func (f UploadedFile) HoldsShard(address string) bool {
+	for _, shardHosts := range f.Hosts {
+		for _, host := range shardHosts {
+			if host == address {
+				return true
+			}
+		}
+	}
+
+	return false
 }
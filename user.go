@@ -9,4 +9,19 @@ type User struct {
 	SpoolCapacityUsed float64  `bson:"spool_capacity_used"` // in gigabytes
 	AwsCapacityUsed   float64  `bson:"aws_capacity_used"`   // in gigabytes
 	NumFilesUploaded  int    `bson:"number_of_files"`
+	CreatedAt         int64   `bson:"created_at"` // in unix time
+	Reputation        float64 `bson:"reputation"` // 0-1, of the user's host
+	Credits           float64 `bson:"credits"`    // earned by hosting shards for other users
+	VersionsKept      int     `bson:"versions_kept"` // versions kept of each file, 0 for the default
+	PublicKey         string  `bson:"public_key"`    // base64, file keys shared with the user are wrapped to it
+	RetentionRules    []RetentionRule `bson:"retention_rules"` // see file_expiry_operations.go
+}
+
+// VersionsToKeep returns how many versions of each file the user keeps.
+func (u User) VersionsToKeep() int {
+	if u.VersionsKept <= 0 {
+		return FILE_VERSIONS_DEFAULT
+	}
+
+	return u.VersionsKept
 }
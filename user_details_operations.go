@@ -3,11 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"log"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // InsertUser inserts the given user into the database.
@@ -17,9 +17,22 @@ func InsertUser(user User) (bool, error) {
 		return false, fmt.Errorf("user already exists")
 	}
 
+	if user.CreatedAt == 0 {
+		user.CreatedAt = time.Now().Unix()
+	}
+	if user.Reputation == 0 {
+		user.Reputation = REPUTATION_DEFAULT
+	}
+
 	if _, err := userDetailsColl.InsertOne(context.Background(), user); err != nil {
 		return false, err
 	} else {
+		EmitWebhookEvent(EVENT_USER_REGISTERED, map[string]interface{}{
+			"user_name":     user.UserName,
+			"account_type":  user.AccountType,
+			"registered_at": user.CreatedAt,
+		})
+
 		if user.AccountType == MONTHLY_SUB {
 			if ok, err := IncrementTotalStoragePoolSize(MONTHLY_STORAGE_ALLOCATION_SIZE); err != nil {
 				return false, err
@@ -50,10 +63,28 @@ func InsertUser(user User) (bool, error) {
 	}
 }
 
+// editableUserFields are the fields UpdateUser may change. The others are kept up to date
+// by the server (credits, reputation) or have their own routes (public_key, retention_rules).
+var editableUserFields = map[string]bool{
+	"address":             true,
+	"relay_address":       true,
+	"timezone":            true,
+	"account_type":        true,
+	"spool_capacity_used": true,
+	"aws_capacity_used":   true,
+	"number_of_files":     true,
+	"versions_kept":       true,
+}
+
 // UpdateUser updates the user with the given address.
 func UpdateUser(fieldName string, fieldValue interface{}, username string) (bool, error) {
+	if !editableUserFields[fieldName] {
+		return false, fmt.Errorf("field %v cannot be updated", fieldName)
+	}
+
 	// Check if the user exists in the database.
-	if _, err := GetUserByUsername(username); err != nil {
+	user, err := GetUserByUsername(username)
+	if err != nil {
 		return false, err
 	}
 
@@ -91,10 +122,48 @@ func UpdateUser(fieldName string, fieldValue interface{}, username string) (bool
 	if _, err := userDetailsColl.UpdateOne(context.Background(), filter, update); err != nil {
 		return false, err
 	} else {
+		if fieldName == "spool_capacity_used" || fieldName == "aws_capacity_used" || fieldName == "account_type" {
+			go evaluateUserAlertsInBackground(username)
+		}
+
+		if fieldName == "account_type" {
+			EmitWebhookEvent(EVENT_USER_PLAN_CHANGED, map[string]interface{}{
+				"user_name":  username,
+				"old_plan":   user.AccountType,
+				"new_plan":   fieldValue,
+				"changed_at": time.Now().Unix(),
+			})
+		} else {
+			EmitWebhookEvent(EVENT_USER_UPDATED, map[string]interface{}{
+				"user_name":   username,
+				"field_name":  fieldName,
+				"field_value": fieldValue,
+			})
+		}
 		return true, nil
 	}
 }
 
+// AdjustUserUsage adds size gigabytes (negative to remove) to the user's storage pool or
+// AWS usage and files to their file count, without touching the network counters.
+func AdjustUserUsage(username string, inStoragePool bool, size float64, files int) error {
+	field := "aws_capacity_used"
+	if inStoragePool {
+		field = "spool_capacity_used"
+	}
+
+	update := bson.D{{Key: "$inc", Value: bson.D{
+		{Key: field, Value: size},
+		{Key: "number_of_files", Value: files},
+	}}}
+	if _, err := userDetailsColl.UpdateOne(context.Background(), bson.D{{Key: "user_name", Value: username}}, update); err != nil {
+		return err
+	}
+
+	go evaluateUserAlertsInBackground(username)
+	return nil
+}
+
 // DeleteUser deletes the user with the given username.
 func DeleteUser(address string) (bool, error) {
 	filter := bson.D{{Key: "user_name", Value: address}}
@@ -105,6 +174,17 @@ func DeleteUser(address string) (bool, error) {
 		if _, err := userDetailsColl.DeleteOne(context.Background(), filter); err != nil {
 			return false, err
 		} else {
+			go evaluateUserAlertsInBackground(address)
+
+			if err := DeleteHost(address); err != nil {
+				log.Println("Unable to remove user from the host registry:", err)
+			}
+			EmitWebhookEvent(EVENT_USER_DELETED, map[string]interface{}{
+				"user_name":    user.UserName,
+				"account_type": user.AccountType,
+				"deleted_at":   time.Now().Unix(),
+			})
+
 			if user.AccountType == MONTHLY_SUB {
 				if ok, err := DecrementTotalStoragePoolSize(MONTHLY_STORAGE_ALLOCATION_SIZE); err != nil {
 					return false, err
@@ -164,34 +244,24 @@ func GetUserByUsername(username string) (User, error) {
 	return result, nil
 }
 
-func GetUsers(amount int) ([]User, error) {
-	var users []User
-
-	numDocs, err := userDetailsColl.CountDocuments(context.TODO(), bson.M{})
-	if err != nil {
-		return nil, err
+// GetUsers returns up to amount distinct random users, leaving out the user named exclude.
+func GetUsers(amount int, exclude string) ([]User, error) {
+	match := bson.D{}
+	if exclude != "" {
+		match = bson.D{{Key: "user_name", Value: bson.D{{Key: "$ne", Value: exclude}}}}
 	}
 
-	var j int
-	if amount > int(numDocs) {
-		j = int(numDocs)
-	} else {
-		j = amount
+	users := []User{}
+	if err := sampleDistinct(userDetailsColl, match, amount, &users); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < j; i++ {
-		// Generate a random number between 0 and the total number of documents in the collection
-		skip := rand.Intn(int(numDocs))
-
-		// Find a random document by skipping the specified number of documents
-		var user User
-		err = userDetailsColl.FindOne(context.TODO(), bson.M{}, options.FindOne().SetSkip(int64(skip))).Decode(&user)
-		if err != nil {
-			return nil, err
-		}
+	return users, nil
+}
 
-		users = append(users, user)
+// evaluateUserAlertsInBackground re-evaluates the user's quota alerts, logging any error.
+func evaluateUserAlertsInBackground(username string) {
+	if err := EvaluateUserAlerts(username); err != nil {
+		log.Println("Unable to evaluate user alerts:", err)
 	}
-
-	return users, nil
 }
@@ -0,0 +1,45 @@
+package main
+
+// WebhookSubscription is an endpoint that is sent the events of the given types. An
+// event type of "*" subscribes to every event.
+type WebhookSubscription struct {
+	ID         string   `bson:"id" json:"id"`
+	URL        string   `bson:"url" json:"url"`
+	EventTypes []string `bson:"event_types" json:"event_types"`
+	Secret     string   `bson:"secret" json:"secret,omitempty"` // used to sign deliveries
+	CreatedAt  int64    `bson:"created_at" json:"created_at"`   // in unix time
+}
+
+// WebhookEvent is an account or file event delivered to webhook subscribers.
+type WebhookEvent struct {
+	ID        string      `bson:"id" json:"id"`
+	Type      string      `bson:"type" json:"type"`
+	CreatedAt int64       `bson:"created_at" json:"created_at"` // in unix time
+	Data      interface{} `bson:"data" json:"data"`
+}
+
+// WebhookDeadLetter is an event that could not be delivered to a subscriber after
+// all retries were exhausted. The event is kept as the JSON body that was sent, so that
+// redelivering it sends exactly the same thing.
+type WebhookDeadLetter struct {
+	ID             string `bson:"id" json:"id"`
+	SubscriptionID string `bson:"subscription_id" json:"subscription_id"`
+	URL            string `bson:"url" json:"url"`
+	EventID        string `bson:"event_id" json:"event_id"`
+	EventType      string `bson:"event_type" json:"event_type"`
+	Body           string `bson:"body" json:"body"`
+	Attempts       int    `bson:"attempts" json:"attempts"`
+	LastError      string `bson:"last_error" json:"last_error"`
+	FailedAt       int64  `bson:"failed_at" json:"failed_at"` // in unix time
+}
+
+// Subscribes reports whether the subscription should receive events of the given type.
+func (s WebhookSubscription) Subscribes(eventType string) bool {
+	for _, subscribed := range s.EventTypes {
+		if subscribed == "*" || subscribed == eventType {
+			return true
+		}
+	}
+
+	return false
+}
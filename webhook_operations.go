@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// InsertWebhookSubscription validates and stores a new webhook subscription. A secret
+// is generated if none is given.
+func InsertWebhookSubscription(subscription WebhookSubscription) (WebhookSubscription, error) {
+	if parsed, err := url.Parse(subscription.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return WebhookSubscription{}, fmt.Errorf("invalid webhook url")
+	}
+
+	if len(subscription.EventTypes) == 0 {
+		return WebhookSubscription{}, fmt.Errorf("no event types provided")
+	}
+	for _, eventType := range subscription.EventTypes {
+		if !isWebhookEventType(eventType) {
+			return WebhookSubscription{}, fmt.Errorf("invalid event type [%v]", eventType)
+		}
+	}
+
+	if subscription.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return WebhookSubscription{}, err
+		}
+		subscription.Secret = hex.EncodeToString(secret)
+	}
+
+	subscription.ID = primitive.NewObjectID().Hex()
+	subscription.CreatedAt = time.Now().Unix()
+
+	if _, err := webhooksColl.InsertOne(context.Background(), subscription); err != nil {
+		return WebhookSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+// GetWebhookSubscriptions returns every webhook subscription.
+func GetWebhookSubscriptions() ([]WebhookSubscription, error) {
+	cursor, err := webhooksColl.Find(context.Background(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []WebhookSubscription{}
+	if err := cursor.All(context.Background(), &subscriptions); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// DeleteWebhookSubscription deletes the webhook subscription with the given ID.
+func DeleteWebhookSubscription(id string) (bool, error) {
+	result, err := webhooksColl.DeleteOne(context.Background(), bson.D{{Key: "id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// EmitWebhookEvent sends the event to every subscription interested in its type. Delivery
+// happens in the background so that the caller is never held up by slow subscribers.
+func EmitWebhookEvent(eventType string, data interface{}) {
+	event := WebhookEvent{
+		ID:        primitive.NewObjectID().Hex(),
+		Type:      eventType,
+		CreatedAt: time.Now().Unix(),
+		Data:      data,
+	}
+
+	go func() {
+		subscriptions, err := GetWebhookSubscriptions()
+		if err != nil {
+			log.Println("Unable to load webhook subscriptions:", err)
+			return
+		}
+
+		for _, subscription := range subscriptions {
+			if subscription.Subscribes(eventType) {
+				go deliverWebhookEvent(subscription, event)
+			}
+		}
+	}()
+}
+
+// deliverWebhookEvent POSTs the event to the subscriber, retrying with exponential backoff.
+// If every attempt fails the event is added to the dead letters.
+func deliverWebhookEvent(subscription WebhookSubscription, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Unable to encode webhook event:", err)
+		return
+	}
+
+	deliverWebhookBody(subscription, event.ID, event.Type, body)
+}
+
+// deliverWebhookBody POSTs the encoded event to the subscriber, retrying with exponential
+// backoff. If every attempt fails the body is added to the dead letters.
+func deliverWebhookBody(subscription WebhookSubscription, eventID string, eventType string, body []byte) {
+	backoff := WEBHOOK_INITIAL_BACKOFF
+	var lastErr error
+
+	for attempt := 1; attempt <= WEBHOOK_MAX_ATTEMPTS; attempt++ {
+		if lastErr = postWebhook(subscription, eventID, eventType, body); lastErr == nil {
+			return
+		}
+
+		log.Printf("Webhook delivery %v to %v failed (attempt %v): %v\n", eventID, subscription.URL, attempt, lastErr)
+
+		if attempt < WEBHOOK_MAX_ATTEMPTS {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	deadLetter := WebhookDeadLetter{
+		ID:             primitive.NewObjectID().Hex(),
+		SubscriptionID: subscription.ID,
+		URL:            subscription.URL,
+		EventID:        eventID,
+		EventType:      eventType,
+		Body:           string(body),
+		Attempts:       WEBHOOK_MAX_ATTEMPTS,
+		LastError:      lastErr.Error(),
+		FailedAt:       time.Now().Unix(),
+	}
+
+	if _, err := webhookDeadLettersColl.InsertOne(context.Background(), deadLetter); err != nil {
+		log.Println("Unable to record webhook dead letter:", err)
+	}
+}
+
+// postWebhook makes a single delivery attempt. The body is signed with the subscription's
+// secret: X-Shr-Signature is the hex HMAC-SHA256 of "<X-Shr-Timestamp>.<body>".
+func postWebhook(subscription WebhookSubscription, eventID string, eventType string, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(subscription.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Shr-Event", eventType)
+	req.Header.Set("X-Shr-Delivery", eventID)
+	req.Header.Set("X-Shr-Timestamp", timestamp)
+	req.Header.Set("X-Shr-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("subscriber returned status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// GetWebhookDeadLetters returns the undeliverable events, most recent first.
+func GetWebhookDeadLetters() ([]WebhookDeadLetter, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "failed_at", Value: -1}})
+
+	cursor, err := webhookDeadLettersColl.Find(context.Background(), bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := []WebhookDeadLetter{}
+	if err := cursor.All(context.Background(), &deadLetters); err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+// RedeliverWebhookDeadLetter removes the dead letter and tries delivering its event again,
+// with the body that failed to be delivered.
+func RedeliverWebhookDeadLetter(id string) error {
+	filter := bson.D{{Key: "id", Value: id}}
+
+	var deadLetter WebhookDeadLetter
+	if err := webhookDeadLettersColl.FindOne(context.Background(), filter).Decode(&deadLetter); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("dead letter not found")
+		}
+		return err
+	}
+
+	var subscription WebhookSubscription
+	if err := webhooksColl.FindOne(context.Background(), bson.D{{Key: "id", Value: deadLetter.SubscriptionID}}).Decode(&subscription); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("webhook subscription no longer exists")
+		}
+		return err
+	}
+
+	if _, err := webhookDeadLettersColl.DeleteOne(context.Background(), filter); err != nil {
+		return err
+	}
+
+	go deliverWebhookBody(subscription, deadLetter.EventID, deadLetter.EventType, []byte(deadLetter.Body))
+	return nil
+}
+
+// DeleteWebhookDeadLetter discards the dead letter with the given ID.
+func DeleteWebhookDeadLetter(id string) (bool, error) {
+	result, err := webhookDeadLettersColl.DeleteOne(context.Background(), bson.D{{Key: "id", Value: id}})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// isWebhookEventType reports whether subscribers can ask for the given event type.
+func isWebhookEventType(eventType string) bool {
+	switch eventType {
+	case "*", EVENT_USER_REGISTERED, EVENT_USER_UPDATED, EVENT_USER_PLAN_CHANGED, EVENT_USER_DELETED,
+		EVENT_FILE_UPLOADED, EVENT_FILE_DELETED:
+		return true
+	default:
+		return false
+	}
+}